@@ -0,0 +1,90 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Types of HelmReleaseSummary conditions
+const (
+	// ConditionDeployed is true if the latest revision of the release is deployed
+	ConditionDeployed = "Deployed"
+	// ConditionHealthy is true if all workloads of the release are ready
+	ConditionHealthy = "Healthy"
+	// ConditionDrifted is true if live objects of the release differ from its manifest
+	ConditionDrifted = "Drifted"
+)
+
+// HelmReleaseSummaryStatus is the state of the latest revision of a helm release
+type HelmReleaseSummaryStatus struct {
+	// Chart is the name of the chart of the release
+	Chart string `json:"chart,omitempty"`
+	// ChartVersion is the version of the chart
+	ChartVersion string `json:"chartVersion,omitempty"`
+	// AppVersion is the app version of the chart
+	AppVersion string `json:"appVersion,omitempty"`
+	// Status is the status of the latest revision (like "deployed")
+	Status string `json:"status,omitempty"`
+	// Revision is the latest revision of the release
+	Revision int `json:"revision,omitempty"`
+	// Description is the description of the latest revision
+	Description string `json:"description,omitempty"`
+	// FirstDeployed is when the release was installed
+	FirstDeployed *metav1.Time `json:"firstDeployed,omitempty"`
+	// LastDeployed is when the latest revision was deployed
+	LastDeployed *metav1.Time `json:"lastDeployed,omitempty"`
+	// Deleted is when the release was uninstalled (with --keep-history)
+	Deleted *metav1.Time `json:"deleted,omitempty"`
+	// Conditions are Deployed, Healthy and Drifted. Healthy and Drifted are
+	// Unknown unless workload health checks and drift detection are enabled.
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=hrs
+//+kubebuilder:printcolumn:name="Chart",type=string,JSONPath=`.status.chart`
+//+kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.chartVersion`
+//+kubebuilder:printcolumn:name="App Version",type=string,JSONPath=`.status.appVersion`
+//+kubebuilder:printcolumn:name="Revision",type=integer,JSONPath=`.status.revision`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.status`
+//+kubebuilder:printcolumn:name="Last Deployed",type=date,JSONPath=`.status.lastDeployed`
+
+// HelmReleaseSummary mirrors the state of a helm release. It is maintained by
+// helm-state-metrics and named like the release.
+type HelmReleaseSummary struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status HelmReleaseSummaryStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// HelmReleaseSummaryList contains a list of HelmReleaseSummary
+type HelmReleaseSummaryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []HelmReleaseSummary `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&HelmReleaseSummary{}, &HelmReleaseSummaryList{})
+}
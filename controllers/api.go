@@ -0,0 +1,213 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// APIPrefix is the path the JSON API is served at
+const APIPrefix = "/api/v1/"
+
+// apiRevision is a revision of a release as returned by the API
+type apiRevision struct {
+	Revision      int        `json:"revision"`
+	Status        string     `json:"status"`
+	Description   string     `json:"description"`
+	Chart         string     `json:"chart"`
+	ChartVersion  string     `json:"chartVersion"`
+	AppVersion    string     `json:"appVersion"`
+	FirstDeployed *time.Time `json:"firstDeployed,omitempty"`
+	LastDeployed  *time.Time `json:"lastDeployed,omitempty"`
+	Deleted       *time.Time `json:"deleted,omitempty"`
+}
+
+// apiRelease is a release (and its latest revision) as returned by the API
+type apiRelease struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	apiRevision
+	// Revisions lists all revisions still stored in the cluster
+	Revisions []int `json:"revisions"`
+}
+
+type apiReleaseList struct {
+	Releases []apiRelease `json:"releases"`
+}
+
+type apiHistory struct {
+	Name      string        `json:"name"`
+	Namespace string        `json:"namespace"`
+	History   []apiRevision `json:"history"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// APIHandler returns the handler of the read-only JSON API, serving:
+//
+//	/api/v1/releases
+//	/api/v1/namespaces/{namespace}/releases
+//	/api/v1/namespaces/{namespace}/releases/{name}
+//	/api/v1/namespaces/{namespace}/releases/{name}/history
+//	/api/v1/namespaces/{namespace}/releases/{name}/diff?from={revision}&to={revision}
+//	/api/v1/watch?since={event ID}&namespace={namespace}
+//
+// It is built from the releases observed by the controller, so it must be
+// called after SetupWithManager (or Snapshot).
+func (r *SecretReconciler) APIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+			return
+		}
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, APIPrefix), "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "watch":
+			r.serveWatch(w, req)
+		case len(parts) == 1 && parts[0] == "releases":
+			writeJSON(w, http.StatusOK, r.apiReleases(req.URL.Query().Get("namespace")))
+		case len(parts) == 3 && parts[0] == "namespaces" && parts[2] == "releases":
+			writeJSON(w, http.StatusOK, r.apiReleases(parts[1]))
+		case len(parts) == 4 && parts[0] == "namespaces" && parts[2] == "releases":
+			release, ok := r.apiRelease(types.NamespacedName{Namespace: parts[1], Name: parts[3]})
+			if !ok {
+				writeJSON(w, http.StatusNotFound, apiError{Error: "release not found"})
+				return
+			}
+			writeJSON(w, http.StatusOK, release)
+		case len(parts) == 5 && parts[0] == "namespaces" && parts[2] == "releases" && parts[4] == "history":
+			key := types.NamespacedName{Namespace: parts[1], Name: parts[3]}
+			history := r.history.history(key)
+			if len(history) == 0 {
+				writeJSON(w, http.StatusNotFound, apiError{Error: "release not found"})
+				return
+			}
+			h := apiHistory{Name: key.Name, Namespace: key.Namespace, History: make([]apiRevision, 0, len(history))}
+			for _, rev := range history {
+				h.History = append(h.History, newAPIRevision(rev))
+			}
+			writeJSON(w, http.StatusOK, h)
+		case len(parts) == 5 && parts[0] == "namespaces" && parts[2] == "releases" && parts[4] == "diff":
+			r.serveDiff(w, req, parts[1], parts[3])
+		default:
+			writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		}
+	})
+}
+
+// serveDiff writes the diff between two revisions of a release as text
+func (r *SecretReconciler) serveDiff(w http.ResponseWriter, req *http.Request, namespace, name string) {
+	var revisions [2]int
+	for i, param := range []string{"from", "to"} {
+		if v := req.URL.Query().Get(param); v != "" {
+			revision, err := strconv.Atoi(v)
+			if err != nil || revision < 1 {
+				writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid revision %q", v)})
+				return
+			}
+			revisions[i] = revision
+		}
+	}
+	diff, err := DiffRevisions(req.Context(), r.Client, namespace, name, revisions[0], revisions[1])
+	if err != nil {
+		if errors.Is(err, helmStorageDriver.ErrReleaseNotFound) {
+			writeJSON(w, http.StatusNotFound, apiError{Error: "revision not found"})
+			return
+		}
+		log.Log.Error(err, "Unable to diff revisions", "namespace", namespace, "release", name)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.WriteString(w, diff); err != nil {
+		log.Log.Error(err, "Unable to write API response")
+	}
+}
+
+// apiReleases returns all releases, limited to namespace if not empty
+func (r *SecretReconciler) apiReleases(namespace string) apiReleaseList {
+	list := apiReleaseList{Releases: []apiRelease{}}
+	for _, key := range r.history.releaseNames() {
+		if namespace != "" && key.Namespace != namespace {
+			continue
+		}
+		if release, ok := r.apiRelease(key); ok {
+			list.Releases = append(list.Releases, release)
+		}
+	}
+	return list
+}
+
+// apiRelease returns the latest revision of a release. The boolean return value
+// is false if the release is not known.
+func (r *SecretReconciler) apiRelease(key types.NamespacedName) (apiRelease, bool) {
+	history := r.history.history(key)
+	if len(history) == 0 {
+		return apiRelease{}, false
+	}
+	release := apiRelease{
+		Name:        key.Name,
+		Namespace:   key.Namespace,
+		apiRevision: newAPIRevision(history[len(history)-1]),
+		Revisions:   make([]int, 0, len(history)),
+	}
+	for _, rev := range history {
+		release.Revisions = append(release.Revisions, rev.Revision)
+	}
+	return release, true
+}
+
+func newAPIRevision(info revisionInfo) apiRevision {
+	timestamp := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	return apiRevision{
+		Revision:      info.Revision,
+		Status:        info.Status.String(),
+		Description:   info.Description,
+		Chart:         info.Chart,
+		ChartVersion:  info.ChartVersion,
+		AppVersion:    info.AppVersion,
+		FirstDeployed: timestamp(info.FirstDeployed),
+		LastDeployed:  timestamp(info.LastDeployed),
+		Deleted:       timestamp(info.Deleted),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Log.Error(err, "Unable to write API response")
+	}
+}
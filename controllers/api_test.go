@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("JSON API", func() {
+	var handler http.Handler
+	deployed := time.Date(2001, 1, 15, 19, 29, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "default"))
+		for i, version := range []string{"0.1.0", "0.2.0"} {
+			secretName, release := newUnicorn("punkunicorn", "default", "punkunicorn", version, "1.0", i+1, rspb.StatusDeployed)
+			Expect(driver.Create(secretName, release)).To(Succeed())
+		}
+		r := &SecretReconciler{Client: c, history: newHistoryStore()}
+		release := types.NamespacedName{Name: "punkunicorn", Namespace: "default"}
+		r.history.observe(release, revisionInfo{Revision: 1, Status: rspb.StatusSuperseded, Chart: "punkunicorn", ChartVersion: "0.1.0",
+			FirstDeployed: deployed, LastDeployed: deployed})
+		r.history.observe(release, revisionInfo{Revision: 2, Status: rspb.StatusDeployed, Description: "Upgrade complete", Chart: "punkunicorn", ChartVersion: "0.2.0",
+			FirstDeployed: deployed, LastDeployed: deployed.Add(time.Hour)})
+		r.history.observe(types.NamespacedName{Name: "other", Namespace: "kube-system"}, revisionInfo{Revision: 1, Status: rspb.StatusDeployed})
+		handler = r.APIHandler()
+	})
+	get := func(path string, v interface{}) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(json.Unmarshal(rec.Body.Bytes(), v)).To(Succeed())
+		return rec.Code
+	}
+
+	It("lists releases", func() {
+		var list apiReleaseList
+		Expect(get("/api/v1/releases", &list)).To(Equal(http.StatusOK))
+		Expect(list.Releases).To(HaveLen(2))
+		Expect(list.Releases[0].Name).To(Equal("punkunicorn"))
+
+		Expect(get("/api/v1/namespaces/kube-system/releases", &list)).To(Equal(http.StatusOK))
+		Expect(list.Releases).To(HaveLen(1))
+		Expect(list.Releases[0].Name).To(Equal("other"))
+	})
+	It("returns the latest revision of a release", func() {
+		var release apiRelease
+		Expect(get("/api/v1/namespaces/default/releases/punkunicorn", &release)).To(Equal(http.StatusOK))
+		Expect(release.Revision).To(Equal(2))
+		Expect(release.Status).To(Equal("deployed"))
+		Expect(release.ChartVersion).To(Equal("0.2.0"))
+		Expect(*release.LastDeployed).To(BeTemporally("==", deployed.Add(time.Hour)))
+		Expect(release.Deleted).To(BeNil())
+		Expect(release.Revisions).To(Equal([]int{1, 2}))
+	})
+	It("returns the history of a release", func() {
+		var history apiHistory
+		Expect(get("/api/v1/namespaces/default/releases/punkunicorn/history", &history)).To(Equal(http.StatusOK))
+		Expect(history.History).To(HaveLen(2))
+		Expect(history.History[0].Status).To(Equal("superseded"))
+	})
+	It("returns the diff between two revisions", func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/releases/punkunicorn/diff", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(ContainSubstring("-version: 0.1.0\n+version: 0.2.0\n"))
+
+		var apiErr apiError
+		Expect(get("/api/v1/namespaces/default/releases/punkunicorn/diff?from=3", &apiErr)).To(Equal(http.StatusNotFound))
+		Expect(get("/api/v1/namespaces/default/releases/punkunicorn/diff?to=foo", &apiErr)).To(Equal(http.StatusBadRequest))
+	})
+	It("returns errors for unknown releases and paths", func() {
+		var apiErr apiError
+		Expect(get("/api/v1/namespaces/default/releases/unknown", &apiErr)).To(Equal(http.StatusNotFound))
+		Expect(apiErr.Error).To(Equal("release not found"))
+		Expect(get("/api/v1/foo", &apiErr)).To(Equal(http.StatusNotFound))
+	})
+})
@@ -0,0 +1,351 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Maximum length of a line read from an existing audit log
+const maxAuditRecordSize = 1 << 20
+
+// auditRecord is a line of the audit log. Hash is the SHA-256 of the record
+// (encoded as JSON without Hash), which includes the hash of the previous
+// record, so records can't be modified or removed without breaking the chain.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Release   string    `json:"release"`
+	Revision  int       `json:"revision"`
+	// PreviousRevision is not set if there is no previous revision (anymore)
+	PreviousRevision int    `json:"previousRevision,omitempty"`
+	Chart            string `json:"chart"`
+	ChartVersion     string `json:"chartVersion"`
+	AppVersion       string `json:"appVersion"`
+	Status           string `json:"status"`
+	Description      string `json:"description"`
+	ConfigHash       string `json:"configHash"`
+	// ChangedValues are the top-level keys of the user supplied values that
+	// differ from the previous revision. It is null if the previous revision
+	// is no longer available.
+	ChangedValues []string `json:"changedValues"`
+	// OutOfWindow is set for revisions deployed during a freeze or outside of
+	// the allowed deployment windows while helm-state-metrics was running.
+	OutOfWindow *auditOutOfWindow `json:"outOfWindow,omitempty"`
+	PrevHash    string            `json:"prevHash"`
+	Hash        string            `json:"hash,omitempty"`
+}
+
+// auditOutOfWindow is a deployment window violation of an audit record
+type auditOutOfWindow struct {
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// hash returns the hash of the record
+func (rec auditRecord) hash() (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	return hashBytes(data), nil
+}
+
+// AuditLog writes a JSON-lines record for every observed state of every
+// revision of all releases.
+type AuditLog struct {
+	mu sync.Mutex
+	// path of the log file, empty when writing to stdout
+	path       string
+	maxSize    int64
+	maxBackups int
+	w          io.Writer
+	file       *os.File
+	size       int64
+	// lastHash is the hash of the latest record
+	lastHash string
+	// recorded holds the status last recorded per revision, so restarts don't
+	// duplicate records
+	recorded map[auditKey]string
+}
+
+type auditKey struct {
+	release  types.NamespacedName
+	revision int
+}
+
+// NewAuditLog returns an audit log writing to the file at path, or stdout if
+// path is "-". Files are rotated when they would grow beyond maxSize bytes
+// (if greater than zero), keeping maxBackups old files (named path.1 and so
+// on). The hash chain is continued from existing files. Nothing is replayed when
+// writing to stdout, so every revision is recorded again after a restart.
+func NewAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{maxSize: maxSize, maxBackups: maxBackups, recorded: map[auditKey]string{}}
+	if path == "-" {
+		a.w = os.Stdout
+		return a, nil
+	}
+	a.path = path
+	// Replay all files, oldest first
+	for i := maxBackups; i >= 0; i-- {
+		if err := a.replay(a.backupPath(i)); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// replay restores the state of the log from an existing file. A partial last
+// line, left behind by a crash while writing, is truncated.
+func (a *AuditLog) replay(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) == 0 {
+				return nil
+			}
+			log.Log.Info("Truncating partial record at the end of audit log", "path", path, "offset", offset)
+			return os.Truncate(path, offset)
+		} else if err != nil {
+			return err
+		}
+		var rec auditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("unable to parse audit log %q: %w", path, err)
+		}
+		offset += int64(len(line))
+		a.lastHash = rec.Hash
+		a.recorded[auditKey{types.NamespacedName{Name: rec.Release, Namespace: rec.Namespace}, rec.Revision}] = rec.Status
+	}
+}
+
+func (a *AuditLog) backupPath(i int) string {
+	if i == 0 {
+		return a.path
+	}
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.w, a.size = f, f, stat.Size()
+	return nil
+}
+
+// rotate moves the current file to path.1 (and path.1 to path.2 and so on)
+// and opens a new one.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.maxBackups == 0 {
+		if err := os.Remove(a.path); err != nil {
+			return err
+		}
+	}
+	for i := a.maxBackups - 1; i >= 0; i-- {
+		if err := os.Rename(a.backupPath(i), a.backupPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// changed returns true if status is not what was recorded last for revision
+// of release.
+func (a *AuditLog) changed(release types.NamespacedName, revision int, status rspb.Status) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	recorded, ok := a.recorded[auditKey{release, revision}]
+	return !ok || recorded != status.String()
+}
+
+// forget drops the state of a deleted revision of release
+func (a *AuditLog) forget(release types.NamespacedName, revision int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.recorded, auditKey{release, revision})
+}
+
+// write chains and appends rec to the log
+func (a *AuditLog) write(rec auditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec.PrevHash = a.lastHash
+	hash, err := rec.hash()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if a.file != nil && a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("unable to rotate audit log: %w", err)
+		}
+	}
+	n, err := a.w.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	a.lastHash = hash
+	a.recorded[auditKey{types.NamespacedName{Name: rec.Release, Namespace: rec.Namespace}, rec.Revision}] = rec.Status
+	return nil
+}
+
+// Close closes the log file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of the records read from r and returns
+// the hash of the last one. prevHash is the hash of the record before the
+// first one. If it is empty, the first record is not checked against its
+// predecessor (which might have been rotated away). An error is returned for
+// the first record that was modified or does not follow its predecessor.
+func VerifyAuditLog(r io.Reader, prevHash string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxAuditRecordSize)
+	for line := 1; scanner.Scan(); line++ {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return "", fmt.Errorf("line %d: %w", line, err)
+		}
+		hash, err := rec.hash()
+		if err != nil {
+			return "", fmt.Errorf("line %d: %w", line, err)
+		}
+		if hash != rec.Hash {
+			return "", fmt.Errorf("line %d: hash mismatch, the record has been modified", line)
+		}
+		if (line > 1 || prevHash != "") && rec.PrevHash != prevHash {
+			return "", fmt.Errorf("line %d: previous hash mismatch, records have been removed or reordered", line)
+		}
+		prevHash = rec.Hash
+	}
+	return prevHash, scanner.Err()
+}
+
+// changedValues returns the sorted top-level keys that differ between the
+// values a and b. Values are compared by their JSON encoding, so decoded and
+// literal numbers are equal.
+func changedValues(a, b map[string]interface{}) []string {
+	equal := func(x, y interface{}) bool {
+		jx, errX := json.Marshal(x)
+		jy, errY := json.Marshal(y)
+		return errX == nil && errY == nil && bytes.Equal(jx, jy)
+	}
+	changed := []string{}
+	for k, v := range b {
+		if old, ok := a[k]; !ok || !equal(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// auditRevision writes an audit record for the current state of release
+// unless it has been recorded already. outOfWindow is the deployment window
+// violation of the revision, if any.
+func (r *SecretReconciler) auditRevision(driver *helmStorageDriver.Secrets, releaseKey types.NamespacedName, release *rspb.Release, outOfWindow *windowViolation) error {
+	if !r.AuditLog.changed(releaseKey, release.Version, release.Info.Status) {
+		return nil
+	}
+	hash, err := configHash(release.Config)
+	if err != nil {
+		return err
+	}
+	rec := auditRecord{
+		Time:         time.Now().UTC(),
+		Namespace:    releaseKey.Namespace,
+		Release:      releaseKey.Name,
+		Revision:     release.Version,
+		Chart:        formatChartName(release.Chart),
+		ChartVersion: formatChartVersion(release.Chart),
+		AppVersion:   formatAppVersion(release.Chart),
+		Status:       release.Info.Status.String(),
+		Description:  release.Info.Description,
+		ConfigHash:   hash,
+	}
+	if outOfWindow != nil {
+		rec.OutOfWindow = &auditOutOfWindow{Reason: outOfWindow.Reason, Detail: outOfWindow.Detail}
+	}
+	if release.Version == 1 {
+		rec.ChangedValues = changedValues(nil, release.Config)
+	} else {
+		// Revisions are consecutive, so the previous one is gone if it does not exist
+		previous, err := driver.Get(releaseSecretName(release.Name, release.Version-1))
+		if err == nil {
+			rec.PreviousRevision = previous.Version
+			rec.ChangedValues = changedValues(previous.Config, release.Config)
+		} else if !errors.Is(err, helmStorageDriver.ErrReleaseNotFound) {
+			return err
+		}
+	}
+	return r.AuditLog.write(rec)
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Audit log", func() {
+	var path string
+	release := types.NamespacedName{Name: "punkunicorn", Namespace: "default"}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "audit.log")
+	})
+	readRecords := func(path string) []auditRecord {
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		var records []auditRecord
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var rec auditRecord
+			Expect(json.Unmarshal([]byte(line), &rec)).To(Succeed())
+			records = append(records, rec)
+		}
+		return records
+	}
+
+	It("records every change of a revision once", func() {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "default"))
+		auditLog, err := NewAuditLog(path, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		r := &SecretReconciler{AuditLog: auditLog}
+
+		_, first := newUnicorn("punkunicorn", "default", "punkunicorn", "0.1.0", "1.0", 1, rspb.StatusDeployed)
+		first.Config = map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}, "replicas": 2}
+		Expect(driver.Create(releaseSecretName("punkunicorn", 1), first)).To(Succeed())
+		_, second := newUnicorn("punkunicorn", "default", "punkunicorn", "0.2.0", "1.1", 2, rspb.StatusPendingUpgrade)
+		second.Config = map[string]interface{}{"image": map[string]interface{}{"tag": "1.1"}, "replicas": 2, "debug": true}
+
+		Expect(r.auditRevision(driver, release, first, nil)).To(Succeed())
+		Expect(r.auditRevision(driver, release, second, nil)).To(Succeed())
+		second.Info.Status = rspb.StatusDeployed
+		Expect(r.auditRevision(driver, release, second, nil)).To(Succeed())
+		// Unchanged
+		Expect(r.auditRevision(driver, release, second, nil)).To(Succeed())
+		Expect(auditLog.Close()).To(Succeed())
+
+		records := readRecords(path)
+		Expect(records).To(HaveLen(3))
+		Expect(records[0].PreviousRevision).To(BeZero())
+		Expect(records[0].ChangedValues).To(Equal([]string{"image", "replicas"}))
+		Expect(records[0].PrevHash).To(BeEmpty())
+		Expect(records[1]).To(And(
+			HaveField("Revision", 2),
+			HaveField("PreviousRevision", 1),
+			HaveField("ChartVersion", "0.2.0"),
+			HaveField("AppVersion", "1.1"),
+			HaveField("Status", "pending-upgrade"),
+			HaveField("ConfigHash", mustConfigHash(second.Config)),
+			HaveField("ChangedValues", []string{"debug", "image"}),
+			HaveField("PrevHash", records[0].Hash),
+		))
+		Expect(records[2].Status).To(Equal("deployed"))
+
+		// The chain and state are continued after a restart
+		auditLog, err = NewAuditLog(path, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		r.AuditLog = auditLog
+		Expect(r.auditRevision(driver, release, second, nil)).To(Succeed())
+		_, third := newUnicorn("punkunicorn", "default", "punkunicorn", "0.2.0", "1.1", 3, rspb.StatusFailed)
+		Expect(r.auditRevision(driver, release, third, nil)).To(Succeed())
+		Expect(auditLog.Close()).To(Succeed())
+
+		records = readRecords(path)
+		Expect(records).To(HaveLen(4))
+		// The previous revision does not exist
+		Expect(records[3].ChangedValues).To(BeNil())
+		Expect(records[3].PrevHash).To(Equal(records[2].Hash))
+	})
+	It("records deployments outside of the allowed windows", func() {
+		config := filepath.Join(GinkgoT().TempDir(), "windows.yaml")
+		Expect(os.WriteFile(config, []byte(`
+freezes:
+  - start: "2001-01-15"
+    end: "2001-01-16"
+    reason: Unicorn migration
+`), 0o644)).To(Succeed())
+		windows, err := NewDeploymentWindows(config)
+		Expect(err).ToNot(HaveOccurred())
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "default"))
+		auditLog, err := NewAuditLog(path, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		r := &SecretReconciler{AuditLog: auditLog, DeploymentWindows: windows, recorder: record.NewFakeRecorder(1)}
+
+		secretName, rel := newUnicorn("punkunicorn", "default", "punkunicorn", "0.1.0", "1.0", 1, rspb.StatusDeployed)
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: secretName, Namespace: "default"}}
+		outOfWindow := r.checkDeploymentWindow(context.Background(), req, rel)
+		Expect(outOfWindow).ToNot(BeNil())
+		Expect(r.auditRevision(driver, release, rel, outOfWindow)).To(Succeed())
+		Expect(auditLog.Close()).To(Succeed())
+
+		records := readRecords(path)
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].OutOfWindow).To(Equal(&auditOutOfWindow{Reason: "freeze", Detail: "Unicorn migration"}))
+		f, err := os.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		_, err = VerifyAuditLog(f, "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	It("rotates files and continues the chain", func() {
+		auditLog, err := NewAuditLog(path, 1, 2)
+		Expect(err).ToNot(HaveOccurred())
+		for i := 1; i <= 4; i++ {
+			Expect(auditLog.write(auditRecord{Namespace: "default", Release: "punkunicorn", Revision: i})).To(Succeed())
+		}
+		Expect(auditLog.Close()).To(Succeed())
+
+		// The record of revision 1 was rotated away
+		Expect(path + ".3").ToNot(BeAnExistingFile())
+		hash := ""
+		for _, p := range []string{path + ".2", path + ".1", path} {
+			f, err := os.Open(p)
+			Expect(err).ToNot(HaveOccurred())
+			hash, err = VerifyAuditLog(f, hash)
+			f.Close()
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(readRecords(path)[0].Revision).To(Equal(4))
+	})
+	It("truncates a partial last record", func() {
+		auditLog, err := NewAuditLog(path, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		for i := 1; i <= 2; i++ {
+			Expect(auditLog.write(auditRecord{Namespace: "default", Release: "punkunicorn", Revision: i, Status: "deployed"})).To(Succeed())
+		}
+		Expect(auditLog.Close()).To(Succeed())
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString(`{"time":"2001-01-15T19:29:00Z","namespace":"def`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		auditLog, err = NewAuditLog(path, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auditLog.changed(release, 2, rspb.StatusDeployed)).To(BeFalse())
+		Expect(auditLog.write(auditRecord{Namespace: "default", Release: "punkunicorn", Revision: 3, Status: "deployed"})).To(Succeed())
+		Expect(auditLog.Close()).To(Succeed())
+		f, err = os.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		_, err = VerifyAuditLog(f, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readRecords(path)).To(HaveLen(3))
+	})
+	It("detects modified and removed records", func() {
+		auditLog, err := NewAuditLog(path, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		for i := 1; i <= 3; i++ {
+			Expect(auditLog.write(auditRecord{Namespace: "default", Release: "punkunicorn", Revision: i, Status: "deployed"})).To(Succeed())
+		}
+		Expect(auditLog.Close()).To(Succeed())
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = VerifyAuditLog(bytes.NewReader(data), "")
+		Expect(err).ToNot(HaveOccurred())
+
+		modified := bytes.Replace(data, []byte(`"revision":2,`), []byte(`"revision":5,`), 1)
+		_, err = VerifyAuditLog(bytes.NewReader(modified), "")
+		Expect(err).To(MatchError(ContainSubstring("line 2: hash mismatch")))
+
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		removed := append(append([]byte{}, lines[0]...), lines[2]...)
+		_, err = VerifyAuditLog(bytes.NewReader(removed), "")
+		Expect(err).To(MatchError(ContainSubstring("line 2: previous hash mismatch")))
+	})
+	It("lists changed top-level values", func() {
+		a := map[string]interface{}{"a": 1, "b": []interface{}{"x"}, "c": "removed"}
+		b := map[string]interface{}{"a": 1, "b": []interface{}{"y"}, "d": "added"}
+		Expect(changedValues(a, b)).To(Equal([]string{"b", "c", "d"}))
+		Expect(changedValues(a, a)).To(BeEmpty())
+		Expect(changedValues(nil, nil)).To(Equal([]string{}))
+	})
+})
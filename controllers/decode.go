@@ -0,0 +1,110 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	rspb "helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Header of gzip compressed releases
+var magicGzip = []byte{0x1f, 0x8b, 0x08}
+
+// DecodeRelease decodes a release from a Secret or ConfigMap of the helm
+// storage drivers (in YAML or JSON) or from the value of their release key.
+func DecodeRelease(data []byte) (*rspb.Release, error) {
+	var object struct {
+		Kind string `json:"kind"`
+	}
+	if err := yaml.Unmarshal(data, &object); err != nil || object.Kind == "" {
+		// Not an object, so the value of the release key
+		return decodeReleaseValue(strings.TrimSpace(string(data)))
+	}
+	switch object.Kind {
+	case "Secret":
+		var secret corev1.Secret
+		if err := yaml.Unmarshal(data, &secret); err != nil {
+			return nil, err
+		}
+		release, ok := secret.Data["release"]
+		if !ok {
+			return nil, fmt.Errorf("secret %s/%s has no release key", secret.Namespace, secret.Name)
+		}
+		return decodeReleaseData(string(release))
+	case "ConfigMap":
+		var configMap corev1.ConfigMap
+		if err := yaml.Unmarshal(data, &configMap); err != nil {
+			return nil, err
+		}
+		release, ok := configMap.Data["release"]
+		if !ok {
+			return nil, fmt.Errorf("configmap %s/%s has no release key", configMap.Namespace, configMap.Name)
+		}
+		return decodeReleaseData(release)
+	default:
+		return nil, fmt.Errorf("unable to decode a release from a %s, expected a Secret or ConfigMap", object.Kind)
+	}
+}
+
+// decodeReleaseValue decodes the value of the release key of a ConfigMap or,
+// as the data of Secrets is base64 encoded once more, of a Secret.
+func decodeReleaseValue(value string) (*rspb.Release, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("base64: %w", err)
+	}
+	if !bytes.HasPrefix(b, magicGzip) && !bytes.HasPrefix(b, []byte("{")) {
+		if _, err := base64.StdEncoding.DecodeString(string(b)); err == nil {
+			return decodeReleaseData(string(b))
+		}
+	}
+	return decodeReleaseData(value)
+}
+
+// decodeReleaseData decodes data the way the helm storage drivers do: base64,
+// gunzip (unless stored before compression was introduced) and JSON. Errors
+// name the failing step.
+func decodeReleaseData(data string) (*rspb.Release, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("base64: %w", err)
+	}
+	if bytes.HasPrefix(b, magicGzip) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		defer r.Close()
+		if b, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+	}
+	var release rspb.Release
+	if err := json.Unmarshal(b, &release); err != nil {
+		return nil, fmt.Errorf("json: %w", err)
+	}
+	return &release, nil
+}
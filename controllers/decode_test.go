@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+var _ = Describe("Decode", func() {
+	var secret corev1.Secret
+
+	BeforeEach(func() {
+		// Encoded by the helm storage driver
+		c := fake.NewClientBuilder().Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "default"))
+		secretName, rel := newUnicorn("decodeunicorn", "default", "decodeunicorn", "0.1.0", "1.0", 3, rspb.StatusDeployed)
+		Expect(driver.Create(secretName, rel)).To(Succeed())
+		Expect(c.Get(context.Background(), types.NamespacedName{Name: secretName, Namespace: "default"}, &secret)).To(Succeed())
+		secret.APIVersion, secret.Kind = "v1", "Secret"
+	})
+
+	expectUnicorn := func(release *rspb.Release, err error) {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(release.Name).To(Equal("decodeunicorn"))
+		Expect(release.Version).To(Equal(3))
+		Expect(release.Chart.Metadata.Version).To(Equal("0.1.0"))
+	}
+
+	It("decodes Secrets in YAML and JSON", func() {
+		data, err := yaml.Marshal(secret)
+		Expect(err).ToNot(HaveOccurred())
+		expectUnicorn(DecodeRelease(data))
+		data, err = json.Marshal(secret)
+		Expect(err).ToNot(HaveOccurred())
+		expectUnicorn(DecodeRelease(data))
+	})
+	It("decodes ConfigMaps", func() {
+		configMap := corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Name: secret.Name, Namespace: "default"},
+			Data:       map[string]string{"release": string(secret.Data["release"])},
+		}
+		data, err := yaml.Marshal(configMap)
+		Expect(err).ToNot(HaveOccurred())
+		expectUnicorn(DecodeRelease(data))
+	})
+	It("decodes values of the release key", func() {
+		// Of a ConfigMap
+		expectUnicorn(DecodeRelease(secret.Data["release"]))
+		// Of a Secret (base64 encoded once more), as printed by kubectl
+		expectUnicorn(DecodeRelease([]byte(base64.StdEncoding.EncodeToString(secret.Data["release"]) + "\n")))
+	})
+	It("decodes uncompressed releases", func() {
+		data, err := json.Marshal(rspb.Release{Name: "legacy", Version: 1})
+		Expect(err).ToNot(HaveOccurred())
+		release, err := DecodeRelease([]byte(base64.StdEncoding.EncodeToString(data)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(release.Name).To(Equal("legacy"))
+	})
+	It("names the failing step", func() {
+		_, err := DecodeRelease([]byte("not base64!"))
+		Expect(err).To(MatchError(HavePrefix("base64: ")))
+		_, err = DecodeRelease([]byte(base64.StdEncoding.EncodeToString(append(magicGzip, 0, 0))))
+		Expect(err).To(MatchError(HavePrefix("gzip: ")))
+		_, err = DecodeRelease([]byte(base64.StdEncoding.EncodeToString([]byte("{broken"))))
+		Expect(err).To(MatchError(HavePrefix("json: ")))
+
+		delete(secret.Data, "release")
+		data, err := yaml.Marshal(secret)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = DecodeRelease(data)
+		Expect(err).To(MatchError(ContainSubstring("has no release key")))
+		_, err = DecodeRelease([]byte("apiVersion: v1\nkind: Pod\n"))
+		Expect(err).To(MatchError(ContainSubstring("expected a Secret or ConfigMap")))
+	})
+})
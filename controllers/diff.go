@@ -0,0 +1,416 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// Number of unchanged lines shown around changes
+const diffContext = 3
+
+// Regex to split a manifest into its documents
+var reManifestSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// DiffRevisions returns the diff (see DiffReleases) between the revisions from
+// and to of a release. to defaults to the latest revision and from to the
+// latest revision before to (or to nothing, if to is the first revision that
+// still exists). helmStorageDriver.ErrReleaseNotFound is returned if one of the
+// revisions does not exist.
+func DiffRevisions(ctx context.Context, c client.Client, namespace, name string, from, to int) (string, error) {
+	revisions, err := releaseRevisions(ctx, c, namespace, name)
+	if err != nil {
+		return "", err
+	}
+	if to == 0 {
+		if len(revisions) == 0 {
+			return "", helmStorageDriver.ErrReleaseNotFound
+		}
+		to = revisions[len(revisions)-1]
+	}
+	if from == 0 {
+		for _, revision := range revisions {
+			if revision < to {
+				from = revision
+			}
+		}
+	}
+	driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, namespace))
+	var fromRelease *rspb.Release
+	if from != 0 {
+		if fromRelease, err = driver.Get(releaseSecretName(name, from)); err != nil {
+			return "", err
+		}
+	}
+	toRelease, err := driver.Get(releaseSecretName(name, to))
+	if err != nil {
+		return "", err
+	}
+	return DiffReleases(fromRelease, toRelease)
+}
+
+// releaseSecretName returns the name of the secret of a revision of a release
+func releaseSecretName(name string, revision int) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", name, revision)
+}
+
+// releaseRevisions returns the sorted revisions of a release according to the
+// labels of its secrets.
+func releaseRevisions(ctx context.Context, c client.Reader, namespace, name string) ([]int, error) {
+	var secrets corev1.SecretList
+	if err := c.List(ctx, &secrets, client.InNamespace(namespace), client.MatchingLabels{"owner": "helm", "name": name}); err != nil {
+		return nil, err
+	}
+	var revisions []int
+	for _, s := range secrets.Items {
+		if revision, err := strconv.Atoi(s.Labels["version"]); err == nil {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Ints(revisions)
+	return revisions, nil
+}
+
+// DiffReleases returns a unified diff of the chart metadata, user supplied
+// values and manifest of two revisions of a release. Values and Secret data
+// that look like credentials are replaced by a short hash, so changes to them
+// are still visible. from may be nil to diff against nothing.
+func DiffReleases(from, to *rspb.Release) (string, error) {
+	nameFrom := func(section string) string { return "/dev/null" }
+	if from != nil {
+		nameFrom = func(section string) string {
+			return fmt.Sprintf("%s/%s revision %d %s", from.Namespace, from.Name, from.Version, section)
+		}
+	} else {
+		from = &rspb.Release{}
+	}
+	var b strings.Builder
+	sections := []struct {
+		name   string
+		render func(*rspb.Release) (string, error)
+	}{
+		{"chart", renderChartMetadata},
+		{"values", renderValues},
+		{"manifest", func(r *rspb.Release) (string, error) { return redactManifest(r.Manifest), nil }},
+	}
+	for _, s := range sections {
+		a, err := s.render(from)
+		if err != nil {
+			return "", err
+		}
+		c, err := s.render(to)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(unifiedDiff(
+			nameFrom(s.name),
+			fmt.Sprintf("%s/%s revision %d %s", to.Namespace, to.Name, to.Version, s.name),
+			a, c))
+	}
+	return b.String(), nil
+}
+
+func renderChartMetadata(r *rspb.Release) (string, error) {
+	if r.Chart == nil || r.Chart.Metadata == nil {
+		return "", nil
+	}
+	data, err := yaml.Marshal(r.Chart.Metadata)
+	return string(data), err
+}
+
+func renderValues(r *rspb.Release) (string, error) {
+	if len(r.Config) == 0 {
+		return "", nil
+	}
+	data, err := yaml.Marshal(redactValues("", r.Config))
+	return string(data), err
+}
+
+// redactValues returns a copy of v with all strings that look like credentials
+// (see isSuspectedSecret) replaced.
+func redactValues(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			redacted[k] = redactValues(k, e)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, e := range v {
+			redacted[i] = redactValues(key, e)
+		}
+		return redacted
+	case string:
+		if isSuspectedSecret(key, v) {
+			return redacted(v)
+		}
+	}
+	return v
+}
+
+// redactManifest replaces the data of all Secret objects in manifest.
+func redactManifest(manifest string) string {
+	docs := reManifestSeparator.Split(manifest, -1)
+	for i, doc := range docs {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil || obj["kind"] != "Secret" {
+			continue
+		}
+		for _, field := range []string{"data", "stringData"} {
+			data, ok := obj[field].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for k, v := range data {
+				data[k] = redacted(fmt.Sprint(v))
+			}
+		}
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			continue
+		}
+		// Keep comments like "# Source: chart/templates/secret.yaml"
+		body := strings.TrimLeft(doc, "\n")
+		var comments []string
+		for _, line := range strings.Split(body, "\n") {
+			if !strings.HasPrefix(line, "#") {
+				break
+			}
+			comments = append(comments, line)
+		}
+		docs[i] = doc[:len(doc)-len(body)] + strings.Join(append(comments, string(out)), "\n")
+	}
+	return strings.Join(docs, "---")
+}
+
+func redacted(value string) string {
+	return fmt.Sprintf("<redacted sha256:%.8s>", hashBytes([]byte(value)))
+}
+
+// diffOp is a line of a diff, kind is one of ' ', '-' and '+'
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the unified diff of the texts a and b, or an empty string
+// if they are equal.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	lineA, lineB := 0, 0
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			lineA++
+			lineB++
+			i++
+			continue
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		// Extend the hunk until there are more than 2*diffContext unchanged lines
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		startA, startB := lineA-(i-start), lineB-(i-start)
+		countA, countB := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", hunkStart(startA, countA), countA, hunkStart(startB, countB), countB)
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.line)
+		}
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				lineA++
+			}
+			if op.kind != '-' {
+				lineB++
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkStart returns the line number of a hunk in unified diff notation
+func hunkStart(start, count int) int {
+	if count == 0 {
+		return start
+	}
+	return start + 1
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the shortest edit script transforming a into b, using the
+// linear space variant of the Myers diff algorithm.
+func diffLines(a, b []string) []diffOp {
+	return myers(make([]diffOp, 0, len(a)+len(b)), a, b)
+}
+
+// myers appends the shortest edit script transforming a into b to ops. The
+// middle snake of the script is searched from both ends, then the parts before
+// and after it are diffed recursively, which needs O(len(a)+len(b)) memory
+// only.
+func myers(ops []diffOp, a, b []string) []diffOp {
+	// Common prefixes and suffixes are not part of the search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, diffOp{' ', a[prefix]})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+	default:
+		x, y := middleSnake(a, b)
+		ops = myers(ops, a[:x], b[:y])
+		ops = myers(ops, a[x:], b[y:])
+	}
+	for _, line := range common {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// middleSnake returns a point on the shortest edit script transforming a into
+// b that splits it into two halves of (almost) the same length. a and b must
+// not be empty and not start or end with the same line.
+func middleSnake(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	// vf[k+max] and vb[k+max] hold the furthest x reached on diagonal k
+	// (x-y) from the start and, in reversed coordinates, from the end.
+	vf, vb := make([]int, 2*max+2), make([]int, 2*max+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[max+1], vb[max+1] = 0, 0
+	delta := n - m
+	// The paths from the start overlap with the paths from the end first
+	// after an odd number of steps if delta is odd
+	front := delta%2 != 0
+	// Diagonals left of kStart and right of kEnd left the edit graph
+	kfStart, kfEnd, kbStart, kbEnd := 0, 0, 0, 0
+	for d := 0; d < max; d++ {
+		for k := -d + kfStart; k <= d-kfEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[max+k-1] < vf[max+k+1]) {
+				x = vf[max+k+1]
+			} else {
+				x = vf[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[max+k] = x
+			switch {
+			case x > n:
+				kfEnd += 2
+			case y > m:
+				kfStart += 2
+			case front:
+				if kb := max + delta - k; kb >= 0 && kb < len(vb) && vb[kb] != -1 && x >= n-vb[kb] {
+					return x, y
+				}
+			}
+		}
+		for k := -d + kbStart; k <= d-kbEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vb[max+k-1] < vb[max+k+1]) {
+				x = vb[max+k+1]
+			} else {
+				x = vb[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			vb[max+k] = x
+			switch {
+			case x > n:
+				kbEnd += 2
+			case y > m:
+				kbStart += 2
+			case !front:
+				if kf := max + delta - k; kf >= 0 && kf < len(vf) && vf[kf] != -1 && vf[kf] >= n-x {
+					return vf[kf], vf[kf] - (delta - k)
+				}
+			}
+		}
+	}
+	// Not reached for valid input, the halves are replaced entirely
+	return n, 0
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chart"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Revision diff", func() {
+	It("returns nothing for equal texts", func() {
+		Expect(unifiedDiff("a", "b", "foo\nbar\n", "foo\nbar\n")).To(BeEmpty())
+	})
+	It("returns unified diffs with context", func() {
+		a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+		b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n15\n16\n"
+		Expect(unifiedDiff("a", "b", a, b)).To(Equal(`--- a
++++ b
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -11,5 +11,5 @@
+ 11
+ 12
+ 13
+-14
+ 15
++16
+`))
+	})
+	It("diffs from and to empty texts", func() {
+		Expect(unifiedDiff("a", "b", "", "foo\n")).To(Equal("--- a\n+++ b\n@@ -0,0 +1,1 @@\n+foo\n"))
+		Expect(unifiedDiff("a", "b", "foo\n", "")).To(Equal("--- a\n+++ b\n@@ -1,1 +0,0 @@\n-foo\n"))
+	})
+	It("finds minimal edit scripts", func() {
+		ops := diffLines([]string{"a", "b", "c", "a", "b", "b", "a"}, []string{"c", "b", "a", "b", "a", "c"})
+		changes := 0
+		for _, op := range ops {
+			if op.kind != ' ' {
+				changes++
+			}
+		}
+		Expect(changes).To(Equal(5))
+	})
+	It("finds minimal edit scripts of random texts", func() {
+		random := rand.New(rand.NewSource(GinkgoRandomSeed()))
+		lines := func() []string {
+			l := make([]string, random.Intn(40))
+			for i := range l {
+				l[i] = string(rune('a' + random.Intn(4)))
+			}
+			return l
+		}
+		for i := 0; i < 500; i++ {
+			a, b := lines(), lines()
+			// Length of the longest common subsequence
+			lcs := make([][]int, len(a)+1)
+			for i := range lcs {
+				lcs[i] = make([]int, len(b)+1)
+			}
+			for i := len(a) - 1; i >= 0; i-- {
+				for j := len(b) - 1; j >= 0; j-- {
+					if a[i] == b[j] {
+						lcs[i][j] = lcs[i+1][j+1] + 1
+					} else if lcs[i+1][j] > lcs[i][j+1] {
+						lcs[i][j] = lcs[i+1][j]
+					} else {
+						lcs[i][j] = lcs[i][j+1]
+					}
+				}
+			}
+
+			gotA, gotB := []string{}, []string{}
+			changes := 0
+			for _, op := range diffLines(a, b) {
+				if op.kind != '+' {
+					gotA = append(gotA, op.line)
+				}
+				if op.kind != '-' {
+					gotB = append(gotB, op.line)
+				}
+				if op.kind != ' ' {
+					changes++
+				}
+			}
+			Expect(gotA).To(Equal(a), "diff of %v and %v", a, b)
+			Expect(gotB).To(Equal(b), "diff of %v and %v", a, b)
+			Expect(changes).To(Equal(len(a)+len(b)-2*lcs[0][0]), "diff of %v and %v", a, b)
+		}
+	})
+	It("redacts values that look like credentials", func() {
+		values := map[string]interface{}{
+			"image":    map[string]interface{}{"tag": "1.2.3"},
+			"database": map[string]interface{}{"password": "hunter22"},
+		}
+		Expect(redactValues("", values)).To(Equal(map[string]interface{}{
+			"image":    map[string]interface{}{"tag": "1.2.3"},
+			"database": map[string]interface{}{"password": redacted("hunter22")},
+		}))
+		Expect(redacted("hunter22")).To(MatchRegexp(`^<redacted sha256:[0-9a-f]{8}>$`))
+		// The input is not modified
+		Expect(values["database"]).To(HaveKeyWithValue("password", "hunter22"))
+	})
+	It("redacts Secret data in manifests", func() {
+		manifest := `---
+# Source: foo/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: foo
+data:
+  password: aHVudGVyMjI=
+---
+# Source: foo/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+data:
+  password: not-redacted
+`
+		redactedManifest := redactManifest(manifest)
+		Expect(redactedManifest).To(ContainSubstring("# Source: foo/templates/secret.yaml\n"))
+		Expect(redactedManifest).ToNot(ContainSubstring("aHVudGVyMjI="))
+		Expect(redactedManifest).To(ContainSubstring("password: " + redacted("aHVudGVyMjI=")))
+		Expect(redactedManifest).To(ContainSubstring("password: not-redacted"))
+	})
+	It("diffs chart metadata, values and manifests of two revisions", func() {
+		from := &rspb.Release{Name: "foo", Namespace: "default", Version: 1,
+			Chart:    &chart.Chart{Metadata: &chart.Metadata{Name: "foo", Version: "0.1.0"}},
+			Config:   map[string]interface{}{"replicas": 1},
+			Manifest: "kind: ConfigMap\n"}
+		to := &rspb.Release{Name: "foo", Namespace: "default", Version: 2,
+			Chart:    &chart.Chart{Metadata: &chart.Metadata{Name: "foo", Version: "0.2.0"}},
+			Config:   map[string]interface{}{"replicas": 1},
+			Manifest: "kind: Secret\n"}
+		diff, err := DiffReleases(from, to)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff).To(ContainSubstring("--- default/foo revision 1 chart\n+++ default/foo revision 2 chart\n"))
+		Expect(diff).To(ContainSubstring("-version: 0.1.0\n+version: 0.2.0\n"))
+		Expect(diff).ToNot(ContainSubstring("values"))
+		Expect(diff).To(ContainSubstring("-kind: ConfigMap\n+kind: Secret\n"))
+	})
+	It("diffs against the latest existing revision before to", func() {
+		c := fake.NewClientBuilder().Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "default"))
+		create := func(revision int, status rspb.Status) {
+			secretName, rel := newUnicorn("diffunicorn", "default", "diffunicorn", "0.1."+fmt.Sprint(revision), "1.0", revision, status)
+			Expect(driver.Create(secretName, rel)).To(Succeed())
+		}
+		create(3, rspb.StatusDeployed)
+		diff, err := DiffRevisions(context.Background(), c, "default", "diffunicorn", 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff).To(ContainSubstring("--- /dev/null\n+++ default/diffunicorn revision 3 chart\n"))
+		Expect(diff).To(ContainSubstring("+version: 0.1.3\n"))
+
+		// Revision 4 was pruned
+		create(5, rspb.StatusDeployed)
+		diff, err = DiffRevisions(context.Background(), c, "default", "diffunicorn", 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff).To(ContainSubstring("--- default/diffunicorn revision 3 chart\n+++ default/diffunicorn revision 5 chart\n"))
+
+		_, err = DiffRevisions(context.Background(), c, "default", "diffunicorn", 4, 0)
+		Expect(err).To(MatchError(helmStorageDriver.ErrReleaseNotFound))
+		_, err = DiffRevisions(context.Background(), c, "default", "missing", 0, 0)
+		Expect(err).To(MatchError(helmStorageDriver.ErrReleaseNotFound))
+	})
+})
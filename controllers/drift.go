@@ -0,0 +1,280 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Kinds whose spec.replicas is managed by a HorizontalPodAutoscaler if targeted by one
+var scalableKinds = map[string]bool{"Deployment": true, "StatefulSet": true, "ReplicaSet": true}
+
+// driftResult is the result of comparing the objects of a release manifest
+// with their live counterparts
+type driftResult struct {
+	// Drifted is the number of drifted objects per kind
+	Drifted map[string]int
+	// Missing is the number of objects that do not exist (anymore)
+	Missing int
+	// Details lists the first drifted field of each drifted object
+	Details []string
+	// Errors lists the objects that could not be read (like kinds the
+	// controller is not allowed to read), which are not compared
+	Errors []string
+}
+
+// isPermanentError returns true for errors reading objects that retrying
+// won't fix.
+func isPermanentError(err error) bool {
+	return apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) || apierrors.IsMethodNotSupported(err)
+}
+
+// objectKey returns the key of a manifest object, defaulting the namespace of
+// namespaced objects to the release namespace.
+func objectKey(mapper meta.RESTMapper, obj *unstructured.Unstructured, namespace string) (types.NamespacedName, error) {
+	key := types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}
+	gvk := obj.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return key, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		key.Namespace = ""
+	} else if key.Namespace == "" {
+		key.Namespace = namespace
+	}
+	return key, nil
+}
+
+// detectDrift compares the fields set in the manifest objects objs with the
+// live objects read from reader. ignorePaths are field paths (like
+// ".spec.replicas" or "Deployment:.spec.replicas") not to compare. Objects
+// that can't be read for permanent reasons are skipped and listed in Errors,
+// so a single kind the controller is not allowed to read doesn't fail the
+// detection for all objects.
+func detectDrift(ctx context.Context, reader client.Reader, mapper meta.RESTMapper, namespace string, objs []*unstructured.Unstructured, ignorePaths []string) (driftResult, error) {
+	result := driftResult{Drifted: map[string]int{}}
+
+	autoscaled, err := autoscaledObjects(ctx, reader, namespace, objs)
+	if err != nil {
+		if !isPermanentError(err) {
+			return result, err
+		}
+		result.Errors = append(result.Errors, fmt.Sprintf("HorizontalPodAutoscaler: %v", err))
+	}
+
+	for _, obj := range objs {
+		key, err := objectKey(mapper, obj, namespace)
+		if err != nil {
+			if meta.IsNoMatchError(err) {
+				// The API (e.g. a CRD) does no longer exist
+				result.Missing++
+				continue
+			}
+			return result, err
+		}
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(obj.GroupVersionKind())
+		if err := reader.Get(ctx, key, live); err != nil {
+			if apierrors.IsNotFound(err) {
+				result.Missing++
+				continue
+			}
+			if isPermanentError(err) {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s/%s: %v", obj.GetKind(), obj.GetName(), err))
+				continue
+			}
+			return result, err
+		}
+
+		ignore := ignoredPaths(obj.GetKind(), ignorePaths)
+		if scalableKinds[obj.GetKind()] && autoscaled[obj.GetKind()+"/"+obj.GetName()] {
+			ignore[".spec.replicas"] = true
+		}
+		if path, drifted := compareFields("", desiredFields(obj), live.Object, ignore); drifted {
+			result.Drifted[obj.GetKind()]++
+			result.Details = append(result.Details, fmt.Sprintf("%s/%s: %s", obj.GetKind(), obj.GetName(), path))
+		}
+	}
+	return result, nil
+}
+
+// desiredFields returns the fields of a manifest object helm sets and that are
+// not expected to be changed by the API server.
+func desiredFields(obj *unstructured.Unstructured) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for k, v := range obj.Object {
+		switch k {
+		case "apiVersion", "kind", "status", "stringData":
+			// stringData is write-only and merged into data by the API server
+			continue
+		case "metadata":
+			md := map[string]interface{}{}
+			for _, f := range []string{"labels", "annotations"} {
+				if v, ok := obj.Object["metadata"].(map[string]interface{})[f]; ok {
+					md[f] = v
+				}
+			}
+			fields[k] = md
+		default:
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// ignoredPaths returns the set of field paths to ignore for objects of kind
+func ignoredPaths(kind string, paths []string) map[string]bool {
+	ignore := map[string]bool{}
+	for _, p := range paths {
+		if k, path, found := strings.Cut(p, ":"); found {
+			if k == kind {
+				ignore[path] = true
+			}
+			continue
+		}
+		ignore[p] = true
+	}
+	return ignore
+}
+
+// compareFields recursively compares all fields of desired with the fields of
+// live. Fields only present in live are ignored as they might have been
+// defaulted by the API server. It returns the path of the first difference.
+func compareFields(path string, desired, live interface{}, ignore map[string]bool) (string, bool) {
+	if ignore[path] {
+		return "", false
+	}
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return path, len(d) > 0
+		}
+		for k, v := range d {
+			if p, drifted := compareFields(path+"."+k, v, l[k], ignore); drifted {
+				return p, true
+			}
+		}
+		return "", false
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return path, len(d) > 0 || len(l) > 0
+		}
+		for i := range d {
+			if p, drifted := compareFields(fmt.Sprintf("%s[%d]", path, i), d[i], l[i], ignore); drifted {
+				return p, true
+			}
+		}
+		return "", false
+	case nil:
+		// null in a manifest means "not set"
+		return "", false
+	}
+	if equalScalars(desired, live) {
+		return "", false
+	}
+	return path, true
+}
+
+// equalScalars compares two scalar values, treating numbers of different types
+// and different notations of the same resource quantity (like "0.5" and
+// "500m") as equal.
+func equalScalars(desired, live interface{}) bool {
+	if reflect.DeepEqual(desired, live) {
+		return true
+	}
+	if d, ok := toFloat(desired); ok {
+		if l, ok := toFloat(live); ok {
+			return d == l
+		}
+	}
+	ds, dok := desired.(string)
+	ls, lok := live.(string)
+	if !dok || !lok {
+		// The API server converts int-or-string values like "80" to numbers
+		return fmt.Sprint(desired) == fmt.Sprint(live)
+	}
+	dq, err := resource.ParseQuantity(ds)
+	if err != nil {
+		return false
+	}
+	lq, err := resource.ParseQuantity(ls)
+	if err != nil {
+		return false
+	}
+	return dq.Cmp(lq) == 0
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// autoscaledObjects returns the set of objects ("Kind/name") in namespace that
+// are the target of a HorizontalPodAutoscaler in objs or in the cluster. If
+// the HorizontalPodAutoscalers in the cluster can't be listed, the targets of
+// the ones in objs are returned along with the error.
+func autoscaledObjects(ctx context.Context, reader client.Reader, namespace string, objs []*unstructured.Unstructured) (map[string]bool, error) {
+	targets := map[string]bool{}
+	for _, obj := range objs {
+		if obj.GetKind() != "HorizontalPodAutoscaler" {
+			continue
+		}
+		kind, _, _ := unstructured.NestedString(obj.Object, "spec", "scaleTargetRef", "kind")
+		name, _, _ := unstructured.NestedString(obj.Object, "spec", "scaleTargetRef", "name")
+		targets[kind+"/"+name] = true
+	}
+	var hpas autoscalingv2.HorizontalPodAutoscalerList
+	err := reader.List(ctx, &hpas, client.InNamespace(namespace))
+	if meta.IsNoMatchError(err) {
+		// autoscaling/v2 is only served since Kubernetes 1.23
+		var v1hpas autoscalingv1.HorizontalPodAutoscalerList
+		if err := reader.List(ctx, &v1hpas, client.InNamespace(namespace)); err != nil {
+			return targets, err
+		}
+		for _, hpa := range v1hpas.Items {
+			targets[hpa.Spec.ScaleTargetRef.Kind+"/"+hpa.Spec.ScaleTargetRef.Name] = true
+		}
+		return targets, nil
+	}
+	if err != nil {
+		return targets, err
+	}
+	for _, hpa := range hpas.Items {
+		targets[hpa.Spec.ScaleTargetRef.Kind+"/"+hpa.Spec.ScaleTargetRef.Name] = true
+	}
+	return targets, nil
+}
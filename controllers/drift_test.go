@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// noAutoscalingV2Reader is a reader of a cluster not serving autoscaling/v2
+type noAutoscalingV2Reader struct {
+	client.Reader
+}
+
+func (r noAutoscalingV2Reader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*autoscalingv2.HorizontalPodAutoscalerList); ok {
+		return &meta.NoKindMatchError{GroupKind: autoscalingv2.SchemeGroupVersion.WithKind("HorizontalPodAutoscaler").GroupKind(), SearchedVersions: []string{"v2"}}
+	}
+	return r.Reader.List(ctx, list, opts...)
+}
+
+// errorReader fails to read ConfigMaps and to list HorizontalPodAutoscalers
+// with err
+type errorReader struct {
+	client.Reader
+	err error
+}
+
+func (r errorReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if obj.GetObjectKind().GroupVersionKind().Kind == "ConfigMap" {
+		return r.err
+	}
+	return r.Reader.Get(ctx, key, obj, opts...)
+}
+
+func (r errorReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*autoscalingv2.HorizontalPodAutoscalerList); ok {
+		return r.err
+	}
+	return r.Reader.List(ctx, list, opts...)
+}
+
+var _ = Describe("Drift detection", func() {
+	desired := map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "unicorn"}},
+		"spec": map[string]interface{}{
+			"replicas": int64(2),
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":      "unicorn",
+							"image":     "unicorn:1.0",
+							"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "0.5"}},
+							"ports":     []interface{}{map[string]interface{}{"containerPort": "8080"}},
+						},
+					},
+				},
+			},
+		},
+	}
+	live := func(replicas int64, image string) map[string]interface{} {
+		return map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels":      map[string]interface{}{"app": "unicorn"},
+				"annotations": map[string]interface{}{"meta.helm.sh/release-name": "unicorn"},
+			},
+			"spec": map[string]interface{}{
+				"replicas":             replicas,
+				"revisionHistoryLimit": int64(10),
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"containers": []interface{}{
+							map[string]interface{}{
+								"name":            "unicorn",
+								"image":           image,
+								"imagePullPolicy": "IfNotPresent",
+								"resources":       map[string]interface{}{"limits": map[string]interface{}{"cpu": "500m"}},
+								"ports":           []interface{}{map[string]interface{}{"containerPort": int64(8080), "protocol": "TCP"}},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	It("ignores fields defaulted or normalized by the API server", func() {
+		_, drifted := compareFields("", desired, live(2, "unicorn:1.0"), nil)
+		Expect(drifted).To(BeFalse())
+	})
+	It("detects changed fields", func() {
+		path, drifted := compareFields("", desired, live(2, "unicorn:2.0"), nil)
+		Expect(drifted).To(BeTrue())
+		Expect(path).To(Equal(".spec.template.spec.containers[0].image"))
+	})
+	It("does not compare ignored fields", func() {
+		ignore := ignoredPaths("Deployment", []string{"Deployment:.spec.replicas", "StatefulSet:.spec.template"})
+		Expect(ignore).To(Equal(map[string]bool{".spec.replicas": true}))
+		_, drifted := compareFields("", desired, live(5, "unicorn:1.0"), ignore)
+		Expect(drifted).To(BeFalse())
+	})
+	It("compares manifest objects with live objects", func() {
+		replicas := int32(5)
+		c := fake.NewClientBuilder().WithObjects(
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "unicorn", Namespace: "default"},
+				Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			},
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "unicorn", Namespace: "default"},
+				Data:       map[string]string{"color": "pink"},
+			},
+			&autoscalingv1.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "unicorn", Namespace: "default"},
+				Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+					ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{Kind: "Deployment", Name: "unicorn"},
+				},
+			},
+		).Build()
+		objs, err := parseManifest("---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: unicorn\nspec:\n  replicas: 2\n" +
+			"---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: unicorn\ndata:\n  color: white\n" +
+			"---\napiVersion: v1\nkind: Service\nmetadata:\n  name: unicorn\n")
+		Expect(err).ToNot(HaveOccurred())
+		mapper := meta.NewDefaultRESTMapper(nil)
+		for _, gvk := range []schema.GroupVersionKind{
+			appsv1.SchemeGroupVersion.WithKind("Deployment"),
+			corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+			corev1.SchemeGroupVersion.WithKind("Service"),
+		} {
+			mapper.Add(gvk, meta.RESTScopeNamespace)
+		}
+
+		// The HorizontalPodAutoscaler is read from autoscaling/v1 if v2 is not served
+		result, err := detectDrift(context.Background(), noAutoscalingV2Reader{c}, mapper, "default", objs, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Drifted).To(Equal(map[string]int{"ConfigMap": 1}))
+		Expect(result.Details).To(Equal([]string{"ConfigMap/unicorn: .data.color"}))
+		Expect(result.Missing).To(Equal(1))
+
+		result, err = detectDrift(context.Background(), noAutoscalingV2Reader{c}, mapper, "default", objs, []string{"ConfigMap:.data"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Drifted).To(BeEmpty())
+	})
+	It("skips objects that can't be read", func() {
+		replicas := int32(5)
+		c := fake.NewClientBuilder().WithObjects(&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "unicorn", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		}).Build()
+		objs, err := parseManifest("---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: unicorn\nspec:\n  replicas: 5\n" +
+			"---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: unicorn\ndata:\n  color: white\n")
+		Expect(err).ToNot(HaveOccurred())
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(appsv1.SchemeGroupVersion.WithKind("Deployment"), meta.RESTScopeNamespace)
+		mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+
+		forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "unicorn", errors.New("no RBAC"))
+		result, err := detectDrift(context.Background(), errorReader{c, forbidden}, mapper, "default", objs, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Drifted).To(BeEmpty())
+		Expect(result.Missing).To(BeZero())
+		Expect(result.Errors).To(HaveLen(2))
+		Expect(result.Errors[1]).To(HavePrefix("ConfigMap/unicorn: "))
+
+		// Transient errors fail the detection, so it is retried
+		unavailable := apierrors.NewServiceUnavailable("try again")
+		_, err = detectDrift(context.Background(), errorReader{c, unavailable}, mapper, "default", objs, nil)
+		Expect(apierrors.IsServiceUnavailable(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,102 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Reasons of the Events emitted for releases
+const (
+	eventReasonInstalled             = "Installed"
+	eventReasonUpgraded              = "Upgraded"
+	eventReasonRolledBack            = "RolledBack"
+	eventReasonUninstalled           = "Uninstalled"
+	eventReasonFailed                = "Failed"
+	eventReasonPendingTooLong        = "PendingTooLong"
+	eventReasonDecodeError           = "DecodeError"
+	eventReasonOutOfWindowDeployment = "OutOfWindowDeployment"
+)
+
+// transitionEvent returns the type, reason and message of the Event for a
+// transition of release from revision from to revision to.
+func (r *SecretReconciler) transitionEvent(kind string, release types.NamespacedName, from, to *revisionInfo) (eventType, reason, message string) {
+	switch kind {
+	case transitionInstalled:
+		return corev1.EventTypeNormal, eventReasonInstalled,
+			fmt.Sprintf("Release %s installed chart %s-%s (revision %d)", release.Name, to.Chart, to.ChartVersion, to.Revision)
+	case transitionUpgraded:
+		return corev1.EventTypeNormal, eventReasonUpgraded,
+			fmt.Sprintf("Release %s upgraded to chart %s-%s (revision %d)", release.Name, to.Chart, to.ChartVersion, to.Revision)
+	case transitionRolledBack:
+		target, _ := to.rollbackTo()
+		return corev1.EventTypeNormal, eventReasonRolledBack,
+			fmt.Sprintf("Release %s rolled back to revision %d (revision %d)", release.Name, target, to.Revision)
+	case transitionUninstalled:
+		revision := to
+		if revision == nil {
+			revision = from
+		}
+		return corev1.EventTypeNormal, eventReasonUninstalled,
+			fmt.Sprintf("Release %s uninstalled (revision %d)", release.Name, revision.Revision)
+	case transitionFailed:
+		return corev1.EventTypeWarning, eventReasonFailed,
+			fmt.Sprintf("Release %s failed to deploy chart %s-%s (revision %d): %s", release.Name, to.Chart, to.ChartVersion, to.Revision, to.Description)
+	case transitionPendingTooLong:
+		return corev1.EventTypeWarning, eventReasonPendingTooLong,
+			fmt.Sprintf("Release %s has been %s for longer than %s (revision %d)", release.Name, to.Status, r.PendingTimeout, to.Revision)
+	}
+	return "", "", ""
+}
+
+// parseEventsObject resolves an object reference like "configmap/name" or
+// "deployment.apps/name" (as accepted by kubectl) to the kind and name of
+// the object.
+func parseEventsObject(mapper meta.RESTMapper, s string) (*corev1.ObjectReference, error) {
+	resource, name, ok := strings.Cut(s, "/")
+	if !ok || resource == "" || name == "" {
+		return nil, fmt.Errorf("invalid object %q, expected RESOURCE/NAME", s)
+	}
+	gvk, err := mapper.KindFor(schema.ParseGroupResource(resource).WithVersion(""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid object %q: %w", s, err)
+	}
+	apiVersion, kind := gvk.ToAPIVersionAndKind()
+	return &corev1.ObjectReference{APIVersion: apiVersion, Kind: kind, Name: name}, nil
+}
+
+// emitEvent emits an Event about a release in namespace for EventsObject or,
+// if not set, for the release secret secretName. The secret is referenced by
+// name only, so Events can be emitted after it has been deleted (like on
+// uninstall). Without a recorder (like in snapshots) nothing is emitted.
+func (r *SecretReconciler) emitEvent(namespace, secretName, eventType, reason, message string) {
+	if r.recorder == nil {
+		return
+	}
+	ref := corev1.ObjectReference{APIVersion: "v1", Kind: "Secret", Name: secretName}
+	if r.eventsObject != nil {
+		ref = *r.eventsObject
+	}
+	ref.Namespace = namespace
+	r.recorder.Event(&ref, eventType, reason, message)
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Events", func() {
+	var r *SecretReconciler
+	var recorder *record.FakeRecorder
+	release := types.NamespacedName{Name: "punkunicorn", Namespace: "default"}
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+		secretName, rel := newUnicorn("punkunicorn", "default", "punkunicorn", "0.1.0", "1.0", 1, rspb.StatusFailed)
+		Expect(helmStorageDriver.NewSecrets(NewSecretsClient(c, "default")).Create(secretName, rel)).To(Succeed())
+		recorder = record.NewFakeRecorder(10)
+		r = &SecretReconciler{Client: c, Events: true, PendingTimeout: 15 * time.Minute,
+			transitions: newTransitionBroker(), recorder: recorder}
+	})
+
+	It("emits Events for transitions of a release", func() {
+		r.publishTransition(ctx, transitionFailed, release, nil,
+			&revisionInfo{Revision: 1, Status: rspb.StatusFailed, Chart: "punkunicorn", ChartVersion: "0.1.0", Description: "timed out"})
+		Expect(recorder.Events).To(Receive(Equal("Warning Failed Release punkunicorn failed to deploy chart punkunicorn-0.1.0 (revision 1): timed out")))
+
+		r.publishTransition(ctx, transitionPendingTooLong, release, nil, &revisionInfo{Revision: 1, Status: rspb.StatusPendingUpgrade})
+		Expect(recorder.Events).To(Receive(Equal("Warning PendingTooLong Release punkunicorn has been pending-upgrade for longer than 15m0s (revision 1)")))
+
+		// The release secret is gone after an uninstall without --keep-history
+		recorder.IncludeObject = true
+		r.publishTransition(ctx, transitionUninstalled, release, &revisionInfo{Revision: 2}, nil)
+		Expect(recorder.Events).To(Receive(Equal("Normal Uninstalled Release punkunicorn uninstalled (revision 2) " +
+			"involvedObject{kind=Secret,apiVersion=v1}")))
+	})
+	It("emits Events for a chosen object", func() {
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+		var err error
+		r.eventsObject, err = parseEventsObject(mapper, "configmap/helm-releases")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*r.eventsObject).To(Equal(corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Name: "helm-releases"}))
+		_, err = parseEventsObject(mapper, "configmap")
+		Expect(err).To(HaveOccurred())
+		_, err = parseEventsObject(mapper, "widgets/foo")
+		Expect(err).To(HaveOccurred())
+
+		// The release secret is gone, but the Event can still be emitted
+		r.publishTransition(ctx, transitionUninstalled, release, &revisionInfo{Revision: 2}, nil)
+		Expect(recorder.Events).To(Receive(Equal("Normal Uninstalled Release punkunicorn uninstalled (revision 2)")))
+	})
+	It("describes transitions", func() {
+		eventType, reason, message := r.transitionEvent(transitionRolledBack, release, &revisionInfo{Revision: 2},
+			&revisionInfo{Revision: 3, Description: "Rollback to 1"})
+		Expect([]string{eventType, reason, message}).To(Equal([]string{"Normal", "RolledBack", "Release punkunicorn rolled back to revision 1 (revision 3)"}))
+	})
+})
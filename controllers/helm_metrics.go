@@ -17,8 +17,14 @@ limitations under the License.
 package controllers
 
 import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
@@ -39,18 +45,44 @@ var (
 		//release.StatusUninstalling,
 	}
 
-	metricInfo     *prometheus.GaugeVec
-	metricRevision *prometheus.GaugeVec
-	metricStatus   *prometheus.GaugeVec
-	metricUpdated  *prometheus.GaugeVec
-	metricErrors   *prometheus.CounterVec
+	// Characters not allowed in prometheus label names
+	reInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	metricInfo               *prometheus.GaugeVec
+	metricRevision           *prometheus.GaugeVec
+	metricStatus             *prometheus.GaugeVec
+	metricUpdated            *prometheus.GaugeVec
+	metricErrors             *prometheus.CounterVec
+	metricNamespaceLabels    *prometheus.GaugeVec
+	metricLabels             *prometheus.GaugeVec
+	metricHashInfo           *prometheus.GaugeVec
+	metricValueInfo          *prometheus.GaugeVec
+	metricValue              *prometheus.GaugeVec
+	metricSuspectedSecret    *prometheus.GaugeVec
+	metricPolicy             *prometheus.GaugeVec
+	metricSchemaValid        *prometheus.GaugeVec
+	metricDrifted            *prometheus.GaugeVec
+	metricMissing            *prometheus.GaugeVec
+	metricWorkloadsReady     *prometheus.GaugeVec
+	metricWorkloadsTotal     *prometheus.GaugeVec
+	metricRolloutInProgress  *prometheus.GaugeVec
+	metricRolloutDuration    *prometheus.HistogramVec
+	metricOwnershipConflicts *prometheus.GaugeVec
+	metricDeployments        *prometheus.CounterVec
+	metricChangeFailureRate  *prometheus.GaugeVec
+	metricTimeToRestore      *prometheus.HistogramVec
+	metricRollbacks          *prometheus.CounterVec
+	metricLastRollback       *prometheus.GaugeVec
+	metricLastRollbackInfo   *prometheus.GaugeVec
+	metricFirstDeployed      *prometheus.GaugeVec
+	metricDeleted            *prometheus.GaugeVec
+	metricAge                *ageCollector
+	metricOutOfWindow        *prometheus.CounterVec
+	metricNotifications      *prometheus.CounterVec
 )
 
 func init() {
-	metricInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: metricsPrefix + "info",
-		Help: "Information about helm release",
-	}, append(commonLabels, "chart", "chart_version", "app_version", "revision"))
+	metricInfo = newMetricInfo(nil)
 
 	metricRevision = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: metricsPrefix + "revision",
@@ -72,11 +104,331 @@ func init() {
 		Help: "Errors occurred during metrics generation per namespace"},
 		[]string{"namespace"})
 
+	metricHashInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "hash_info",
+		Help: "Fingerprints of the user supplied values and rendered manifest of a helm release"},
+		append(commonLabels, "config_hash", "manifest_hash"))
+
+	metricValueInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "value_info",
+		Help: "Non-numeric helm release value selected by JSONPath"},
+		append(commonLabels, "path", "value"))
+
+	metricValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "value",
+		Help: "Numeric helm release value selected by JSONPath"},
+		append(commonLabels, "path"))
+
+	metricSuspectedSecret = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "suspected_secret_values",
+		Help: "Helm release values that look like plaintext credentials, in the user supplied values or the chart default values"},
+		append(commonLabels, "path", "source"))
+
+	metricPolicy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "policy_violations",
+		Help: "Number of policy rule violations in the manifest of a helm release"},
+		append(commonLabels, "rule", "severity"))
+
+	metricSchemaValid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "values_schema_valid",
+		Help: "Whether the values of a helm release validate against the values.schema.json of its chart"},
+		commonLabels)
+
+	metricDrifted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "drifted_resources",
+		Help: "Number of objects of a helm release that differ from the release manifest"},
+		append(commonLabels, "kind"))
+
+	metricMissing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "missing_resources",
+		Help: "Number of objects in the manifest of a helm release that do not exist"},
+		commonLabels)
+
+	metricWorkloadsReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "workloads_ready",
+		Help: "Number of workloads of a helm release with all replicas updated and ready"},
+		commonLabels)
+
+	metricWorkloadsTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "workloads_total",
+		Help: "Number of workloads (Deployments, StatefulSets, DaemonSets and Jobs) of a helm release"},
+		commonLabels)
+
+	metricRolloutInProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "rollout_in_progress",
+		Help: "Whether the workloads of the latest revision of a helm release are still rolling out"},
+		commonLabels)
+
+	metricRolloutDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    metricsPrefix + "rollout_duration_seconds",
+		Help:    "Time from deploying a helm release revision until all of its workloads are updated and ready",
+		Buckets: []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200},
+	}, []string{"chart"})
+
+	metricOwnershipConflicts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "ownership_conflicts",
+		Help: "Number of objects of a helm release declared by other releases (duplicate) or owned by other releases according to their annotations (annotation)"},
+		append(commonLabels, "reason"))
+
+	metricDeployments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "deployments_total",
+		Help: "Number of helm release revisions (installs, upgrades and rollbacks) by result"},
+		append(commonLabels, "result"))
+
+	metricChangeFailureRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "change_failure_rate",
+		Help: "Ratio of helm release revisions that failed or were rolled back"},
+		commonLabels)
+
+	metricTimeToRestore = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    metricsPrefix + "time_to_restore_seconds",
+		Help:    "Time from the first failed revision of a helm release until the next successful one",
+		Buckets: []float64{60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400, 259200},
+	}, []string{"namespace"})
+
+	metricRollbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "rollbacks_total",
+		Help: "Number of successful rollbacks of a helm release"},
+		commonLabels)
+
+	metricLastRollback = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "last_rollback_timestamp",
+		Help: "Unix time of the latest rollback of a helm release"},
+		commonLabels)
+
+	metricLastRollbackInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "last_rollback_info",
+		Help: "Revisions of the latest rollback of a helm release"},
+		append(commonLabels, "revision", "rolled_back_from", "rolled_back_to"))
+
+	metricFirstDeployed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "first_deployed_timestamp",
+		Help: "Unix time of the first deployment of a helm release"},
+		commonLabels)
+
+	metricDeleted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "deleted_timestamp",
+		Help: "Unix time a helm release was uninstalled with --keep-history"},
+		commonLabels)
+
+	metricAge = newAgeCollector()
+
+	metricOutOfWindow = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "out_of_window_deployments_total",
+		Help: "Number of helm release revisions deployed during a freeze (freeze) or outside of the allowed windows (outside_window)"},
+		append(commonLabels, "reason"))
+
+	// Not a metric of a release, so it does not share their prefix
+	metricNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "helm_state_metrics_notifications_total",
+		Help: "Number of notifications about release transitions sent (success), given up on after retries (failed) or dropped because the queue of the sink was full (dropped)"},
+		[]string{"sink", "result"})
+
+	// Metrics depending on command line arguments are replaced during setup
+	registerNamespaceLabels(nil)
+	registerReleaseLabels(nil)
+
 	metrics.Registry.MustRegister(
-		metricInfo,
+		replaceableCollector{&metricInfo},
+		replaceableCollector{&metricNamespaceLabels},
+		replaceableCollector{&metricLabels},
 		metricRevision,
 		metricStatus,
 		metricUpdated,
 		metricErrors,
+		metricHashInfo,
+		metricValueInfo,
+		metricValue,
+		metricSuspectedSecret,
+		metricPolicy,
+		metricSchemaValid,
+		metricDrifted,
+		metricMissing,
+		metricWorkloadsReady,
+		metricWorkloadsTotal,
+		metricRolloutInProgress,
+		metricRolloutDuration,
+		metricOwnershipConflicts,
+		metricDeployments,
+		metricChangeFailureRate,
+		metricTimeToRestore,
+		metricRollbacks,
+		metricLastRollback,
+		metricLastRollbackInfo,
+		metricFirstDeployed,
+		metricDeleted,
+		metricAge,
+		metricOutOfWindow,
+		metricNotifications,
 	)
 }
+
+// revisionMetrics returns the metrics describing the currently deployed revision
+// of a release. They are replaced when a new revision is observed.
+func revisionMetrics() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		metricInfo,
+		metricLabels,
+		metricHashInfo,
+		metricValueInfo,
+		metricValue,
+		metricSuspectedSecret,
+		metricPolicy,
+		metricSchemaValid,
+		metricDrifted,
+		metricMissing,
+		metricWorkloadsReady,
+		metricWorkloadsTotal,
+		metricRolloutInProgress,
+		metricOwnershipConflicts,
+		metricDeleted,
+	}
+}
+
+// releaseMetrics returns all metrics of a release. They are removed when the
+// release is deleted.
+func releaseMetrics() []*prometheus.GaugeVec {
+	return append(revisionMetrics(), metricRevision, metricStatus, metricUpdated, metricChangeFailureRate,
+		metricLastRollback, metricLastRollbackInfo, metricFirstDeployed)
+}
+
+// newMetricInfo returns the helm_release_info metric with additional labels
+// for the given Kubernetes label keys (see labelNames).
+func newMetricInfo(labelKeys []string) *prometheus.GaugeVec {
+	labels := append([]string{}, commonLabels...)
+	labels = append(labels, "chart", "chart_version", "app_version", "revision")
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "info",
+		Help: "Information about helm release",
+	}, append(labels, labelNames(labelKeys)...))
+}
+
+// setInfoLabelKeys replaces the helm_release_info metric with one that carries
+// an additional label for each of the given Kubernetes label keys.
+func setInfoLabelKeys(labelKeys []string) {
+	metricInfo = newMetricInfo(labelKeys)
+}
+
+// registerNamespaceLabels replaces the helm_release_namespace_labels metric
+// with one for the given allowlist of namespace label keys.
+func registerNamespaceLabels(allowlist []string) {
+	metricNamespaceLabels = newLabelsMetric("namespace_labels",
+		"Kubernetes labels converted to Prometheus labels",
+		[]string{"namespace"}, allowlist)
+}
+
+// registerReleaseLabels replaces the helm_release_labels metric with one for
+// the given allowlist of helm release label keys.
+func registerReleaseLabels(allowlist []string) {
+	metricLabels = newLabelsMetric("labels",
+		"Helm release labels converted to Prometheus labels",
+		commonLabels, allowlist)
+}
+
+// newLabelsMetric returns an info metric carrying the given labels plus one
+// label per allowlisted Kubernetes label key.
+func newLabelsMetric(name, help string, labels, allowlist []string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + name,
+		Help: help},
+		append(append([]string{}, labels...), labelNames(allowlist)...))
+}
+
+// replaceableCollector collects the metric *metric currently points to. As it
+// describes no metrics, the registry does not remember their label names (not
+// even after Unregister), so the metric can be replaced by one with different
+// labels.
+type replaceableCollector struct {
+	metric **prometheus.GaugeVec
+}
+
+func (c replaceableCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c replaceableCollector) Collect(ch chan<- prometheus.Metric) {
+	(*c.metric).Collect(ch)
+}
+
+// labelNames converts Kubernetes label keys to prometheus label names in the
+// same way kube-state-metrics does ("app.kubernetes.io/name" becomes
+// "label_app_kubernetes_io_name").
+func labelNames(keys []string) []string {
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, "label_"+reInvalidLabelChars.ReplaceAllString(k, "_"))
+	}
+	return names
+}
+
+// ValidateLabelKeys returns an error if Kubernetes label keys map to the same
+// prometheus label name (see labelNames), like "app.name" and "app_name".
+func ValidateLabelKeys(keys []string) error {
+	seen := map[string]string{}
+	for i, name := range labelNames(keys) {
+		if other, ok := seen[name]; ok {
+			if other == keys[i] {
+				return fmt.Errorf("label key %q is given more than once", other)
+			}
+			return fmt.Errorf("label keys %q and %q both map to %s", other, keys[i], name)
+		}
+		seen[name] = keys[i]
+	}
+	return nil
+}
+
+// labelValues returns the values of the given keys from a Kubernetes label map,
+// using an empty string for missing keys.
+func labelValues(keys []string, labels map[string]string) []string {
+	values := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, labels[k])
+	}
+	return values
+}
+
+// ageCollector exports the time since the first deployment of each release. As
+// the value changes constantly, it is calculated on every scrape.
+type ageCollector struct {
+	mu            sync.Mutex
+	desc          *prometheus.Desc
+	firstDeployed map[types.NamespacedName]time.Time
+	now           func() time.Time
+}
+
+func newAgeCollector() *ageCollector {
+	return &ageCollector{
+		desc: prometheus.NewDesc(metricsPrefix+"age_seconds",
+			"Time since the first deployment of a helm release", commonLabels, nil),
+		firstDeployed: map[types.NamespacedName]time.Time{},
+		now:           time.Now,
+	}
+}
+
+// set records the first deployment time of a release.
+func (c *ageCollector) set(release types.NamespacedName, firstDeployed time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.firstDeployed[release] = firstDeployed
+}
+
+// delete removes a (deleted) release.
+func (c *ageCollector) delete(release types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.firstDeployed, release)
+}
+
+// Describe implements prometheus.Collector
+func (c *ageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *ageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for release, firstDeployed := range c.firstDeployed {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+			now.Sub(firstDeployed).Seconds(), release.Name, release.Namespace)
+	}
+}
@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Label metrics helpers", func() {
+	It("converts Kubernetes label keys to prometheus label names", func() {
+		Expect(labelNames([]string{"team", "app.kubernetes.io/name", "git-sha"})).
+			To(Equal([]string{"label_team", "label_app_kubernetes_io_name", "label_git_sha"}))
+	})
+	It("rejects label keys mapping to the same label name", func() {
+		Expect(ValidateLabelKeys([]string{"team", "app.kubernetes.io/name"})).To(Succeed())
+		Expect(ValidateLabelKeys([]string{"a.b", "team", "a_b"})).To(MatchError(`label keys "a.b" and "a_b" both map to label_a_b`))
+		Expect(ValidateLabelKeys([]string{"team", "team"})).To(MatchError(ContainSubstring("more than once")))
+	})
+	It("returns empty values for missing label keys", func() {
+		Expect(labelValues([]string{"team", "tier"}, map[string]string{"team": "sre"})).
+			To(Equal([]string{"sre", ""}))
+	})
+})
+
+var _ = Describe("Age collector", func() {
+	It("exports the time since the first deployment", func() {
+		deployed := time.Date(2001, 1, 15, 19, 29, 0, 0, time.UTC)
+		c := newAgeCollector()
+		c.now = func() time.Time { return deployed.Add(time.Hour) }
+		c.set(types.NamespacedName{Name: "punkunicorn", Namespace: "default"}, deployed)
+		c.set(types.NamespacedName{Name: "gone", Namespace: "default"}, deployed)
+		c.delete(types.NamespacedName{Name: "gone", Namespace: "default"})
+
+		Expect(testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP helm_release_age_seconds Time since the first deployment of a helm release
+# TYPE helm_release_age_seconds gauge
+helm_release_age_seconds{name="punkunicorn",namespace="default"} 3600
+`))).To(Succeed())
+	})
+})
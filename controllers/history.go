@@ -0,0 +1,399 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	rspb "helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Regex to extract the revision a rollback went back to from the release description
+var reRollbackDescription = regexp.MustCompile(`^Rollback to (\d+)`)
+
+// Deployment results as exported by helm_release_deployments_total
+const (
+	resultSuccess = "success"
+	resultFailed  = "failed"
+)
+
+// revisionInfo is what is known about a single revision of a release
+type revisionInfo struct {
+	Revision      int
+	Status        rspb.Status
+	Description   string
+	Chart         string
+	ChartVersion  string
+	AppVersion    string
+	FirstDeployed time.Time
+	LastDeployed  time.Time
+	Deleted       time.Time
+	// RollbackTo is the revision a rollback went back to, if detected from
+	// the history of the release rather than the description
+	RollbackTo int
+}
+
+// newRevisionInfo extracts the revisionInfo from a release
+func newRevisionInfo(r *rspb.Release) revisionInfo {
+	info := revisionInfo{
+		Revision:     r.Version,
+		Chart:        formatChartName(r.Chart),
+		ChartVersion: formatChartVersion(r.Chart),
+		AppVersion:   formatAppVersion(r.Chart),
+	}
+	if r.Info != nil {
+		info.Status = r.Info.Status
+		info.Description = r.Info.Description
+		info.FirstDeployed = r.Info.FirstDeployed.Time
+		info.LastDeployed = r.Info.LastDeployed.Time
+		info.Deleted = r.Info.Deleted.Time
+	}
+	return info
+}
+
+// result returns the deployment result of a revision or an empty string if the
+// revision is not in a final state.
+func (i revisionInfo) result() string {
+	switch i.Status {
+	case rspb.StatusDeployed, rspb.StatusSuperseded:
+		return resultSuccess
+	case rspb.StatusFailed:
+		return resultFailed
+	}
+	return ""
+}
+
+// rollbackTo returns the revision a rollback went back to. The boolean return
+// value is false if the revision is not a rollback.
+func (i revisionInfo) rollbackTo() (int, bool) {
+	if revision, ok := describedRollbackTo(i.Description); ok {
+		return revision, true
+	}
+	return i.RollbackTo, i.RollbackTo > 0
+}
+
+// describedRollbackTo returns the revision a rollback went back to according
+// to the description of a revision (like "Rollback to 2").
+func describedRollbackTo(description string) (int, bool) {
+	match := reRollbackDescription.FindStringSubmatch(description)
+	if match == nil {
+		return 0, false
+	}
+	revision, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, false
+	}
+	return revision, true
+}
+
+// releaseHistory holds all observed revisions of a release
+type releaseHistory struct {
+	revisions map[int]revisionInfo
+	// seen holds all revisions ever observed
+	seen map[int]bool
+	// pendingReported holds the revisions reported as pending for too long
+	pendingReported map[int]bool
+	// counted holds the revisions already counted in helm_release_deployments_total
+	counted map[int]bool
+	// restored holds the revisions already observed as restoring a failed release
+	restored map[int]bool
+	// rollbacks holds the revisions already counted in helm_release_rollbacks_total
+	rollbacks map[int]bool
+}
+
+// historyUpdate is what changed in the history of a release by observing a revision
+type historyUpdate struct {
+	// New is true if the revision has not been observed before
+	New bool
+	// PreviousStatus is the status the revision had when observed before
+	PreviousStatus rspb.Status
+	// Result is the result of a deployment to be counted (if not empty)
+	Result string
+	// Restored are the time to restore durations to be observed
+	Restored []time.Duration
+	// Rollbacks is the number of successful rollbacks to be counted. These
+	// might be earlier revisions only detected as rollbacks now.
+	Rollbacks int
+	// RollbackTo is the revision a rollback went back to, if detected from
+	// the history (see revisionInfo.RollbackTo)
+	RollbackTo int
+}
+
+// rollbackInfo describes a rollback of a release
+type rollbackInfo struct {
+	// Revision is the revision created by the rollback
+	Revision int
+	// From is the revision that was rolled back
+	From int
+	// To is the revision that was rolled back to
+	To        int
+	Timestamp time.Time
+}
+
+// historyStore keeps the history of all releases. It is built from all
+// revision secrets the controller observes, so after a restart it contains
+// the complete history still stored in the cluster.
+type historyStore struct {
+	mu       sync.RWMutex
+	releases map[types.NamespacedName]*releaseHistory
+}
+
+func newHistoryStore() *historyStore {
+	return &historyStore{releases: map[types.NamespacedName]*releaseHistory{}}
+}
+
+// observe records the (possibly changed) state of a revision of a release.
+func (h *historyStore) observe(release types.NamespacedName, info revisionInfo) historyUpdate {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rh, ok := h.releases[release]
+	if !ok {
+		rh = &releaseHistory{
+			revisions:       map[int]revisionInfo{},
+			seen:            map[int]bool{},
+			pendingReported: map[int]bool{},
+			counted:         map[int]bool{},
+			restored:        map[int]bool{},
+			rollbacks:       map[int]bool{},
+		}
+		h.releases[release] = rh
+	}
+	update := historyUpdate{New: !rh.seen[info.Revision], PreviousStatus: rh.revisions[info.Revision].Status}
+	rh.revisions[info.Revision] = info
+	rh.seen[info.Revision] = true
+	// Revisions might be observed out of order, so detect rollbacks of all
+	// revisions again
+	for _, rev := range rh.sorted() {
+		rev.RollbackTo = rh.detectRollback(rev)
+		rh.revisions[rev.Revision] = rev
+	}
+	info = rh.revisions[info.Revision]
+	update.RollbackTo = info.RollbackTo
+	if result := info.result(); result != "" && !rh.counted[info.Revision] {
+		rh.counted[info.Revision] = true
+		update.Result = result
+	}
+
+	// Revisions might be observed out of order (e.g. on startup), so look for
+	// successful rollbacks and successful deployments following failed ones in
+	// the whole history.
+	var failedSince *revisionInfo
+	for _, rev := range rh.sorted() {
+		rev := rev
+		if _, isRollback := rev.rollbackTo(); isRollback && rev.result() == resultSuccess && !rh.rollbacks[rev.Revision] {
+			rh.rollbacks[rev.Revision] = true
+			update.Rollbacks++
+		}
+		switch rev.result() {
+		case resultFailed:
+			if failedSince == nil {
+				failedSince = &rev
+			}
+		case resultSuccess:
+			if failedSince != nil && !rh.restored[rev.Revision] {
+				rh.restored[rev.Revision] = true
+				update.Restored = append(update.Restored, rev.LastDeployed.Sub(failedSince.LastDeployed))
+			}
+			failedSince = nil
+		}
+	}
+	return update
+}
+
+// detectRollback returns the revision that rev went back to if it deployed
+// the chart (name and version) of an earlier successful revision, but not of
+// the revision before it. This detects rollbacks not described as such (like
+// upgrades to the previous chart version). 0 is returned otherwise.
+func (rh *releaseHistory) detectRollback(rev revisionInfo) int {
+	if rev.ChartVersion == "" {
+		return 0
+	}
+	if _, isRollback := describedRollbackTo(rev.Description); isRollback {
+		return 0
+	}
+	previous, ok := rh.revisions[rev.Revision-1]
+	if !ok || (previous.Chart == rev.Chart && previous.ChartVersion == rev.ChartVersion) {
+		return 0
+	}
+	for r := rev.Revision - 2; r > 0; r-- {
+		earlier, ok := rh.revisions[r]
+		if ok && earlier.Chart == rev.Chart && earlier.ChartVersion == rev.ChartVersion && earlier.result() == resultSuccess {
+			return r
+		}
+	}
+	return 0
+}
+
+// changeFailureRate returns the ratio of changes (installs, upgrades and
+// rollbacks) that failed or were rolled back. The boolean return value is
+// false if there are no changes in a final state.
+func (h *historyStore) changeFailureRate(release types.NamespacedName) (float64, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rh, ok := h.releases[release]
+	if !ok {
+		return 0, false
+	}
+	revisions := rh.sorted()
+	changes, failures := 0, 0
+	for i, rev := range revisions {
+		if rev.result() == "" {
+			continue
+		}
+		changes++
+		if rev.result() == resultFailed {
+			failures++
+			continue
+		}
+		if i+1 < len(revisions) && revisions[i+1].Revision == rev.Revision+1 {
+			if _, isRollback := revisions[i+1].rollbackTo(); isRollback {
+				failures++
+			}
+		}
+	}
+	if changes == 0 {
+		return 0, false
+	}
+	return float64(failures) / float64(changes), true
+}
+
+// lastRollback returns the latest successful rollback of a release. The boolean
+// return value is false if there is no rollback in the known history.
+func (h *historyStore) lastRollback(release types.NamespacedName) (rollbackInfo, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rh, ok := h.releases[release]
+	if !ok {
+		return rollbackInfo{}, false
+	}
+	revisions := rh.sorted()
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := revisions[i]
+		to, isRollback := rev.rollbackTo()
+		if !isRollback || rev.result() != resultSuccess {
+			continue
+		}
+		// The rolled back revision is the one deployed before the rollback
+		return rollbackInfo{Revision: rev.Revision, From: rev.Revision - 1, To: to, Timestamp: rev.LastDeployed}, true
+	}
+	return rollbackInfo{}, false
+}
+
+// previous returns the latest known revision of a release before revision. The
+// boolean return value is false if there is none.
+func (h *historyStore) previous(release types.NamespacedName, revision int) (revisionInfo, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rh, ok := h.releases[release]
+	if !ok {
+		return revisionInfo{}, false
+	}
+	var prev revisionInfo
+	found := false
+	for _, rev := range rh.revisions {
+		if rev.Revision < revision && (!found || rev.Revision > prev.Revision) {
+			prev, found = rev, true
+		}
+	}
+	return prev, found
+}
+
+// latest returns the latest known revision of a release. The boolean return
+// value is false if the release is not known.
+func (h *historyStore) latest(release types.NamespacedName) (revisionInfo, bool) {
+	return h.previous(release, math.MaxInt)
+}
+
+// reportPending returns true if revision of a release has not been reported
+// as pending for too long before.
+func (h *historyStore) reportPending(release types.NamespacedName, revision int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rh, ok := h.releases[release]
+	if !ok || rh.pendingReported[revision] {
+		return false
+	}
+	rh.pendingReported[revision] = true
+	return true
+}
+
+// releaseNames returns all releases with a known history, sorted by namespace and name
+func (h *historyStore) releaseNames() []types.NamespacedName {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	list := make([]types.NamespacedName, 0, len(h.releases))
+	for release := range h.releases {
+		list = append(list, release)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Namespace != list[j].Namespace {
+			return list[i].Namespace < list[j].Namespace
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// history returns all known revisions of a release, sorted by revision
+func (h *historyStore) history(release types.NamespacedName) []revisionInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rh, ok := h.releases[release]
+	if !ok {
+		return nil
+	}
+	return rh.sorted()
+}
+
+// remove removes a (deleted) revision from the history of a release. It is not
+// counted again if it shows up again.
+func (h *historyStore) remove(release types.NamespacedName, revision int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rh, ok := h.releases[release]; ok {
+		delete(rh.revisions, revision)
+	}
+}
+
+// forget removes the history of a (deleted) release.
+func (h *historyStore) forget(release types.NamespacedName) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.releases, release)
+}
+
+func (rh *releaseHistory) sorted() []revisionInfo {
+	revisions := make([]revisionInfo, 0, len(rh.revisions))
+	for _, rev := range rh.revisions {
+		revisions = append(revisions, rev)
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Revision < revisions[j].Revision })
+	return revisions
+}
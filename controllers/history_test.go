@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("History store", func() {
+	release := types.NamespacedName{Name: "punkunicorn", Namespace: "default"}
+	deployed := time.Date(2001, 1, 15, 19, 29, 0, 0, time.UTC)
+	revision := func(rev int, status rspb.Status, description string, after time.Duration) revisionInfo {
+		return revisionInfo{Revision: rev, Status: status, Description: description, LastDeployed: deployed.Add(after)}
+	}
+
+	It("counts each revision in a final state once", func() {
+		h := newHistoryStore()
+		update := h.observe(release, revision(1, rspb.StatusPendingInstall, "", 0))
+		Expect(update.New).To(BeTrue())
+		Expect(update.Result).To(BeEmpty())
+		update = h.observe(release, revision(1, rspb.StatusDeployed, "", 0))
+		Expect(update.New).To(BeFalse())
+		Expect(update.Result).To(Equal(resultSuccess))
+		Expect(h.observe(release, revision(1, rspb.StatusSuperseded, "", 0)).Result).To(BeEmpty())
+		Expect(h.observe(release, revision(2, rspb.StatusFailed, "", time.Hour)).Result).To(Equal(resultFailed))
+	})
+	It("measures the time to restore a failed release", func() {
+		h := newHistoryStore()
+		h.observe(release, revision(1, rspb.StatusSuperseded, "", 0))
+		h.observe(release, revision(2, rspb.StatusFailed, "", time.Hour))
+		h.observe(release, revision(3, rspb.StatusFailed, "", 2*time.Hour))
+		update := h.observe(release, revision(4, rspb.StatusDeployed, "", 3*time.Hour))
+		Expect(update.Restored).To(Equal([]time.Duration{2 * time.Hour}))
+
+		// Restores are only observed once
+		Expect(h.observe(release, revision(4, rspb.StatusSuperseded, "", 3*time.Hour)).Restored).To(BeEmpty())
+	})
+	It("reconstructs the history from revisions observed out of order", func() {
+		h := newHistoryStore()
+		h.observe(release, revision(3, rspb.StatusDeployed, "", 2*time.Hour))
+		update := h.observe(release, revision(2, rspb.StatusFailed, "", time.Hour))
+		Expect(update.Restored).To(Equal([]time.Duration{time.Hour}))
+	})
+	It("calculates the change failure rate", func() {
+		h := newHistoryStore()
+		_, ok := h.changeFailureRate(release)
+		Expect(ok).To(BeFalse())
+
+		h.observe(release, revision(1, rspb.StatusSuperseded, "Install complete", 0))
+		h.observe(release, revision(2, rspb.StatusSuperseded, "Upgrade complete", time.Hour))
+		h.observe(release, revision(3, rspb.StatusFailed, "Upgrade failed", 2*time.Hour))
+		h.observe(release, revision(4, rspb.StatusDeployed, "Rollback to 2", 3*time.Hour))
+		rate, ok := h.changeFailureRate(release)
+		Expect(ok).To(BeTrue())
+		Expect(rate).To(Equal(0.25))
+
+		// Successful upgrades that are rolled back count as failed
+		h.observe(release, revision(4, rspb.StatusSuperseded, "Upgrade complete", 3*time.Hour))
+		h.observe(release, revision(5, rspb.StatusDeployed, "Rollback to 3", 4*time.Hour))
+		rate, _ = h.changeFailureRate(release)
+		Expect(rate).To(Equal(0.4))
+	})
+	It("detects rollbacks", func() {
+		h := newHistoryStore()
+		h.observe(release, revision(1, rspb.StatusSuperseded, "Install complete", 0))
+		h.observe(release, revision(2, rspb.StatusSuperseded, "Upgrade complete", time.Hour))
+		_, ok := h.lastRollback(release)
+		Expect(ok).To(BeFalse())
+
+		Expect(h.observe(release, revision(3, rspb.StatusPendingRollback, "Rollback to 1", 2*time.Hour)).Rollbacks).To(BeZero())
+		Expect(h.observe(release, revision(3, rspb.StatusDeployed, "Rollback to 1", 2*time.Hour)).Rollbacks).To(Equal(1))
+		// Rollbacks are only counted once
+		Expect(h.observe(release, revision(3, rspb.StatusSuperseded, "Rollback to 1", 2*time.Hour)).Rollbacks).To(BeZero())
+
+		rollback, ok := h.lastRollback(release)
+		Expect(ok).To(BeTrue())
+		Expect(rollback).To(Equal(rollbackInfo{Revision: 3, From: 2, To: 1, Timestamp: deployed.Add(2 * time.Hour)}))
+	})
+	It("detects rollbacks by chart version", func() {
+		h := newHistoryStore()
+		chartRevision := func(rev int, status rspb.Status, chartVersion string, after time.Duration) revisionInfo {
+			info := revision(rev, status, "Upgrade complete", after)
+			info.Chart, info.ChartVersion = "punkunicorn", chartVersion
+			return info
+		}
+		// Observed out of order
+		update := h.observe(release, chartRevision(4, rspb.StatusDeployed, "0.1.0", 3*time.Hour))
+		Expect(update.RollbackTo).To(BeZero())
+		h.observe(release, chartRevision(1, rspb.StatusSuperseded, "0.1.0", 0))
+		h.observe(release, chartRevision(2, rspb.StatusSuperseded, "0.1.0", time.Hour))
+		update = h.observe(release, chartRevision(3, rspb.StatusSuperseded, "0.2.0", 2*time.Hour))
+		Expect(update.RollbackTo).To(BeZero())
+
+		rollback, ok := h.lastRollback(release)
+		Expect(ok).To(BeTrue())
+		Expect(rollback).To(Equal(rollbackInfo{Revision: 4, From: 3, To: 2, Timestamp: deployed.Add(3 * time.Hour)}))
+		rate, _ := h.changeFailureRate(release)
+		Expect(rate).To(Equal(0.25))
+
+		// Redeploying the same chart version is no rollback
+		update = h.observe(release, chartRevision(5, rspb.StatusDeployed, "0.1.0", 4*time.Hour))
+		Expect(update.RollbackTo).To(BeZero())
+		update = h.observe(release, chartRevision(6, rspb.StatusFailed, "0.3.0", 5*time.Hour))
+		Expect(update.Rollbacks).To(BeZero())
+		update = h.observe(release, chartRevision(7, rspb.StatusDeployed, "0.2.0", 6*time.Hour))
+		Expect(update.RollbackTo).To(Equal(3))
+		Expect(update.Rollbacks).To(Equal(1))
+	})
+	It("counts rollbacks observed before the revision they rolled back", func() {
+		h := newHistoryStore()
+		chartRevision := func(rev int, status rspb.Status, chartVersion string, after time.Duration) revisionInfo {
+			info := revision(rev, status, "Upgrade complete", after)
+			info.Chart, info.ChartVersion = "punkunicorn", chartVersion
+			return info
+		}
+		Expect(h.observe(release, chartRevision(1, rspb.StatusSuperseded, "0.1.0", 0)).Rollbacks).To(BeZero())
+		// Revision 3 is no rollback unless revision 2 deployed another chart version
+		Expect(h.observe(release, chartRevision(3, rspb.StatusDeployed, "0.1.0", 2*time.Hour)).Rollbacks).To(BeZero())
+		Expect(h.observe(release, chartRevision(2, rspb.StatusSuperseded, "0.2.0", time.Hour)).Rollbacks).To(Equal(1))
+		// Rollbacks are only counted once
+		Expect(h.observe(release, chartRevision(3, rspb.StatusDeployed, "0.1.0", 2*time.Hour)).Rollbacks).To(BeZero())
+	})
+	It("forgets deleted revisions and releases", func() {
+		h := newHistoryStore()
+		h.observe(release, revision(1, rspb.StatusSuperseded, "", 0))
+		h.observe(release, revision(2, rspb.StatusDeployed, "", time.Hour))
+		h.remove(release, 1)
+		Expect(h.history(release)).To(HaveLen(1))
+		// Deleted revisions are not counted again
+		Expect(h.observe(release, revision(1, rspb.StatusSuperseded, "", 0)).Result).To(BeEmpty())
+
+		h.forget(release)
+		Expect(h.history(release)).To(BeEmpty())
+	})
+})
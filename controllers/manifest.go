@@ -0,0 +1,88 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// parseManifest splits the rendered manifest of a helm release into the
+// Kubernetes objects it contains.
+func parseManifest(manifest string) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	decoder := yaml.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 4096)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objs, nil
+			}
+			return nil, err
+		}
+		// Empty documents (e.g. templates rendering to nothing)
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+		// Unstructured decodes numbers as int64 where possible (unlike encoding/json)
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(raw); err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+}
+
+// podSpec returns the pod spec of a Pod or of the pod template of a workload
+// object. The boolean return value is false for other kinds of objects.
+func podSpec(obj *unstructured.Unstructured) (map[string]interface{}, bool) {
+	var fields []string
+	switch obj.GetKind() {
+	case "Pod":
+		fields = []string{"spec"}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+		fields = []string{"spec", "template", "spec"}
+	case "CronJob":
+		fields = []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	default:
+		return nil, false
+	}
+	spec, found, err := unstructured.NestedMap(obj.Object, fields...)
+	if err != nil || !found {
+		return nil, false
+	}
+	return spec, true
+}
+
+// podContainers returns all containers (including init containers) of a pod spec.
+func podContainers(spec map[string]interface{}) []map[string]interface{} {
+	var containers []map[string]interface{}
+	for _, field := range []string{"initContainers", "containers"} {
+		list, _, _ := unstructured.NestedSlice(spec, field)
+		for _, c := range list {
+			if container, ok := c.(map[string]interface{}); ok {
+				containers = append(containers, container)
+			}
+		}
+	}
+	return containers
+}
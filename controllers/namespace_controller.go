@@ -0,0 +1,70 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// NamespaceReconciler reconciles a Namespace object
+type NamespaceReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// LabelsAllowlist is the list of namespace label keys exported as
+	// helm_release_namespace_labels.
+	LabelsAllowlist []string
+}
+
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+
+// Reconcile exports the allowlisted labels of a Namespace so they can be joined
+// onto the helm_release metrics.
+func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var ns corev1.Namespace
+	if err := r.Get(ctx, req.NamespacedName, &ns); err != nil {
+		if apierrors.IsNotFound(err) {
+			metricNamespaceLabels.DeletePartialMatch(prometheus.Labels{"namespace": req.Name})
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Unable to get namespace")
+		return ctrl.Result{}, err
+	}
+
+	// Label values might have changed, so drop the old series first
+	metricNamespaceLabels.DeletePartialMatch(prometheus.Labels{"namespace": ns.Name})
+	metricNamespaceLabels.WithLabelValues(append([]string{ns.Name}, labelValues(r.LabelsAllowlist, ns.Labels)...)...).Set(1.0)
+
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	registerNamespaceLabels(r.LabelsAllowlist)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Namespace{}).
+		Complete(r)
+}
@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Namespace controller", func() {
+	ctx := context.Background()
+
+	It("exports the allowlisted labels of namespaces", func() {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "nsunicorn",
+			Labels: map[string]string{"team": "sre", "app.kubernetes.io/part-of": "unicorns", "ignored": "yes"}}}
+		c := fake.NewClientBuilder().WithObjects(ns).Build()
+		r := &NamespaceReconciler{Client: c, LabelsAllowlist: []string{"team", "app.kubernetes.io/part-of", "tier"}}
+		Expect(r.Snapshot(ctx)).To(Succeed())
+		Expect(testutil.CollectAndCount(metricNamespaceLabels)).To(Equal(1))
+		Expect(testutil.ToFloat64(metricNamespaceLabels.WithLabelValues("nsunicorn", "sre", "unicorns", ""))).To(Equal(1.0))
+
+		// Changed labels replace the series
+		ns.Labels["team"] = "serviceops"
+		Expect(c.Update(ctx, ns)).To(Succeed())
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "nsunicorn"}}
+		_, err := r.Reconcile(ctx, req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(testutil.CollectAndCount(metricNamespaceLabels)).To(Equal(1))
+		Expect(testutil.ToFloat64(metricNamespaceLabels.WithLabelValues("nsunicorn", "serviceops", "unicorns", ""))).To(Equal(1.0))
+
+		// Deleted namespaces are no longer exported
+		Expect(c.Delete(ctx, ns)).To(Succeed())
+		_, err = r.Reconcile(ctx, req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(testutil.CollectAndCount(metricNamespaceLabels)).To(Equal(0))
+	})
+})
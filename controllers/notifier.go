@@ -0,0 +1,362 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// Number of transitions queued per sink before new ones are dropped
+	notificationQueueSize = 100
+	// Defaults of the sink configuration
+	defaultNotificationRetries = 3
+	defaultNotificationTimeout = 10 * time.Second
+	// Backoff before the first retry, doubled for every following one
+	notificationBackoff    = time.Second
+	notificationMaxBackoff = time.Minute
+	// Result of notifications dropped because the queue of the sink was full
+	resultDropped = "dropped"
+)
+
+// Types of notification sinks and how to create them
+var notificationSinkTypes = map[string]func(NotificationSinkConfig) (notificationSink, error){
+	"webhook": newWebhookSink,
+}
+
+// Functions available in notification templates in addition to the built-in ones
+var notificationFuncs = template.FuncMap{
+	// json encodes a value as JSON, for example to quote strings in JSON bodies
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// NotificationsConfig is the format of the notifications configuration file
+type NotificationsConfig struct {
+	Sinks []NotificationSinkConfig `json:"sinks"`
+}
+
+// NotificationSinkConfig defines a sink release transitions are sent to
+type NotificationSinkConfig struct {
+	// Name of the sink, used as label of helm_state_metrics_notifications_total
+	Name string `json:"name"`
+	// Type of the sink. Only "webhook" is supported.
+	Type string `json:"type"`
+	// Namespaces and Charts are lists of namespace and chart name patterns
+	// (like "prod-*") of the releases transitions are sent for. Transitions of
+	// all releases are sent if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	Charts     []string `json:"charts,omitempty"`
+	// Transitions is the list of transition types (like "failed") sent. All
+	// transitions are sent if empty.
+	Transitions []string `json:"transitions,omitempty"`
+	// Retries is how often sending a notification is retried. Defaults to 3.
+	Retries *int `json:"retries,omitempty"`
+	// Timeout of sending a notification (like "5s"). Defaults to 10s.
+	Timeout string `json:"timeout,omitempty"`
+	// Webhook configures sinks of type webhook
+	Webhook *WebhookConfig `json:"webhook,omitempty"`
+}
+
+// WebhookConfig defines the HTTP request sent by a webhook sink
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Method of the request. Defaults to POST.
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is a text/template executed with the transition. Defaults to the
+	// transition encoded as JSON.
+	Body string `json:"body,omitempty"`
+}
+
+// notificationSink sends transitions somewhere
+type notificationSink interface {
+	send(ctx context.Context, t transition) error
+}
+
+// permanentError is returned by sinks if retrying would not help
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// sinkWorker filters the transitions of a sink and sends them in the background
+type sinkWorker struct {
+	name        string
+	sink        notificationSink
+	namespaces  []string
+	charts      []string
+	transitions map[string]bool
+	retries     int
+	timeout     time.Duration
+	backoff     time.Duration
+	queue       chan transition
+}
+
+// Notifier sends release transitions to the configured sinks
+type Notifier struct {
+	workers []*sinkWorker
+}
+
+// NewNotifier reads the notifications configuration file at path.
+func NewNotifier(path string) (*Notifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config NotificationsConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse notifications config %q: %w", path, err)
+	}
+
+	n := &Notifier{}
+	names := map[string]bool{}
+	for i, sc := range config.Sinks {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("invalid sink %d: missing name", i)
+		}
+		if names[sc.Name] {
+			return nil, fmt.Errorf("invalid sink %q: duplicate name", sc.Name)
+		}
+		names[sc.Name] = true
+		w, err := newSinkWorker(sc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink %q: %w", sc.Name, err)
+		}
+		n.workers = append(n.workers, w)
+	}
+	return n, nil
+}
+
+func newSinkWorker(sc NotificationSinkConfig) (*sinkWorker, error) {
+	newSink, ok := notificationSinkTypes[sc.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", sc.Type)
+	}
+	sink, err := newSink(sc)
+	if err != nil {
+		return nil, err
+	}
+	w := &sinkWorker{
+		name:       sc.Name,
+		sink:       sink,
+		namespaces: sc.Namespaces,
+		charts:     sc.Charts,
+		retries:    defaultNotificationRetries,
+		timeout:    defaultNotificationTimeout,
+		backoff:    notificationBackoff,
+		queue:      make(chan transition, notificationQueueSize),
+	}
+	if err := validatePatterns(sc.Namespaces); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(sc.Charts); err != nil {
+		return nil, err
+	}
+	if len(sc.Transitions) > 0 {
+		w.transitions = map[string]bool{}
+		for _, t := range sc.Transitions {
+			switch t {
+			case transitionInstalled, transitionUpgraded, transitionFailed, transitionRolledBack,
+				transitionUninstalled, transitionPendingTooLong:
+				w.transitions[t] = true
+			default:
+				return nil, fmt.Errorf("unknown transition %q", t)
+			}
+		}
+	}
+	if sc.Retries != nil {
+		if *sc.Retries < 0 {
+			return nil, fmt.Errorf("negative retries")
+		}
+		w.retries = *sc.Retries
+	}
+	if sc.Timeout != "" {
+		if w.timeout, err = time.ParseDuration(sc.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	return w, nil
+}
+
+// matches returns true if t passes the filters of the sink
+func (w *sinkWorker) matches(t transition) bool {
+	if w.transitions != nil && !w.transitions[t.Type] {
+		return false
+	}
+	return matchPatterns(w.namespaces, t.Namespace) && matchPatterns(w.charts, t.Chart)
+}
+
+// notify queues t for all sinks it matches. It never blocks, transitions are
+// dropped if the queue of a sink is full.
+func (n *Notifier) notify(t transition) {
+	for _, w := range n.workers {
+		if !w.matches(t) {
+			continue
+		}
+		select {
+		case w.queue <- t:
+		default:
+			metricNotifications.WithLabelValues(w.name, resultDropped).Inc()
+			log.Log.Info("Dropping notification, queue is full", "sink", w.name, "type", t.Type,
+				"namespace", t.Namespace, "name", t.Name)
+		}
+	}
+}
+
+// Start sends queued transitions until ctx is done. It implements
+// manager.Runnable.
+func (n *Notifier) Start(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, w := range n.workers {
+		wg.Add(1)
+		go func(w *sinkWorker) {
+			defer wg.Done()
+			w.run(ctx)
+		}(w)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (w *sinkWorker) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-w.queue:
+			result := resultSuccess
+			if err := w.deliver(ctx, t); err != nil {
+				result = resultFailed
+				log.Log.Error(err, "Unable to send notification", "sink", w.name, "type", t.Type,
+					"namespace", t.Namespace, "name", t.Name)
+			}
+			metricNotifications.WithLabelValues(w.name, result).Inc()
+		}
+	}
+}
+
+// deliver sends t, retrying with exponential backoff
+func (w *sinkWorker) deliver(ctx context.Context, t transition) error {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		sendCtx, cancel := context.WithTimeout(ctx, w.timeout)
+		err := w.sink.send(sendCtx, t)
+		cancel()
+		var permanent permanentError
+		if err == nil || attempt >= w.retries || errors.As(err, &permanent) {
+			return err
+		}
+		log.Log.V(1).Info("Retrying notification", "sink", w.name, "error", err.Error(), "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > notificationMaxBackoff {
+			backoff = notificationMaxBackoff
+		}
+	}
+}
+
+// webhookSink sends transitions as HTTP requests
+type webhookSink struct {
+	url     string
+	method  string
+	headers map[string]string
+	body    *template.Template
+	client  *http.Client
+}
+
+func newWebhookSink(sc NotificationSinkConfig) (notificationSink, error) {
+	if sc.Webhook == nil || sc.Webhook.URL == "" {
+		return nil, fmt.Errorf("missing webhook url")
+	}
+	s := &webhookSink{
+		url:     sc.Webhook.URL,
+		method:  sc.Webhook.Method,
+		headers: sc.Webhook.Headers,
+		client:  &http.Client{},
+	}
+	if s.method == "" {
+		s.method = http.MethodPost
+	}
+	if sc.Webhook.Body != "" {
+		var err error
+		if s.body, err = template.New(sc.Name).Funcs(notificationFuncs).Option("missingkey=error").Parse(sc.Webhook.Body); err != nil {
+			return nil, fmt.Errorf("invalid body template: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *webhookSink) send(ctx context.Context, t transition) error {
+	var body bytes.Buffer
+	if s.body != nil {
+		if err := s.body.Execute(&body, t); err != nil {
+			return permanentError{err}
+		}
+	} else if err := json.NewEncoder(&body).Encode(t); err != nil {
+		return permanentError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, s.method, s.url, &body)
+	if err != nil {
+		return permanentError{err}
+	}
+	if s.body == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("unexpected response status %s", resp.Status)
+		// Client errors (apart from rate limiting) won't go away by retrying
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
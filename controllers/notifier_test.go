@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Notifier", func() {
+	var server *httptest.Server
+	var requests chan *http.Request
+	var bodies chan string
+	var failures int32
+
+	newNotifier := func(config string) (*Notifier, error) {
+		path := filepath.Join(GinkgoT().TempDir(), "notifications.yaml")
+		Expect(os.WriteFile(path, []byte(config), 0o644)).To(Succeed())
+		return NewNotifier(path)
+	}
+	start := func(n *Notifier) {
+		for _, w := range n.workers {
+			w.backoff = time.Millisecond
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		go func() {
+			defer GinkgoRecover()
+			Expect(n.Start(ctx)).To(Succeed())
+		}()
+	}
+
+	BeforeEach(func() {
+		requests = make(chan *http.Request, 10)
+		bodies = make(chan string, 10)
+		atomic.StoreInt32(&failures, 0)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			requests <- req
+			bodies <- string(body)
+		}))
+		DeferCleanup(server.Close)
+		metricNotifications.Reset()
+	})
+
+	It("sends templated webhooks for matching transitions", func() {
+		n, err := newNotifier(`
+sinks:
+  - name: chat
+    type: webhook
+    namespaces: ["prod-*"]
+    charts: [punkunicorn]
+    transitions: [failed]
+    webhook:
+      url: ` + server.URL + `
+      method: PUT
+      headers:
+        Content-Type: application/json
+      body: '{"text": {{ printf "%s/%s %s (revision %d)" .Namespace .Name .Type .To.Revision | json }}}'
+`)
+		Expect(err).ToNot(HaveOccurred())
+		start(n)
+
+		n.notify(transition{Type: transitionUpgraded, Namespace: "prod-a", Name: "punkunicorn", Chart: "punkunicorn"})
+		n.notify(transition{Type: transitionFailed, Namespace: "default", Name: "punkunicorn", Chart: "punkunicorn"})
+		n.notify(transition{Type: transitionFailed, Namespace: "prod-a", Name: "other", Chart: "other"})
+		n.notify(transition{Type: transitionFailed, Namespace: "prod-a", Name: "punkunicorn", Chart: "punkunicorn",
+			To: &transitionRevision{Revision: 3}})
+
+		var req *http.Request
+		Eventually(requests).Should(Receive(&req))
+		Expect(req.Method).To(Equal(http.MethodPut))
+		Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(<-bodies).To(Equal(`{"text": "prod-a/punkunicorn failed (revision 3)"}`))
+		Consistently(requests, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(testutil.ToFloat64(metricNotifications.WithLabelValues("chat", resultSuccess))).To(Equal(1.0))
+	})
+	It("retries failed notifications", func() {
+		n, err := newNotifier(`
+sinks:
+  - name: retried
+    type: webhook
+    retries: 2
+    webhook:
+      url: ` + server.URL + `
+  - name: failing
+    type: webhook
+    retries: 0
+    webhook:
+      url: ` + server.URL + `/404
+`)
+		Expect(err).ToNot(HaveOccurred())
+		// The first two attempts fail
+		atomic.StoreInt32(&failures, 2)
+		start(n)
+
+		n.notify(transition{Type: transitionInstalled, Namespace: "default", Name: "punkunicorn"})
+		Eventually(bodies).Should(Receive(ContainSubstring(`"type":"installed"`)))
+		Eventually(func() float64 {
+			return testutil.ToFloat64(metricNotifications.WithLabelValues("retried", resultSuccess))
+		}).Should(Equal(1.0))
+		Eventually(func() float64 {
+			return testutil.ToFloat64(metricNotifications.WithLabelValues("failing", resultFailed))
+		}).Should(Equal(1.0))
+	})
+	It("drops notifications if the queue is full", func() {
+		n, err := newNotifier(`
+sinks:
+  - name: stuck
+    type: webhook
+    webhook:
+      url: ` + server.URL + `
+`)
+		Expect(err).ToNot(HaveOccurred())
+		// Not started, so nothing is taken from the queue
+		for i := 0; i < notificationQueueSize+1; i++ {
+			n.notify(transition{Type: transitionInstalled})
+		}
+		Expect(testutil.ToFloat64(metricNotifications.WithLabelValues("stuck", resultDropped))).To(Equal(1.0))
+	})
+	It("rejects invalid configurations", func() {
+		for _, config := range []string{
+			`sinks: [{name: a, type: email}]`,
+			`sinks: [{name: a, type: webhook}]`,
+			`sinks: [{name: a, type: webhook, transitions: [exploded], webhook: {url: http://localhost}}]`,
+			`sinks: [{name: a, type: webhook, webhook: {url: http://localhost, body: "{{ .Foo"}}]`,
+			`sinks: [{name: a, type: webhook, webhook: {url: http://localhost}}, {name: a, type: webhook, webhook: {url: http://localhost}}]`,
+		} {
+			_, err := newNotifier(config)
+			Expect(err).To(HaveOccurred(), config)
+		}
+	})
+})
@@ -0,0 +1,286 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Extensions of the files read from directories
+var offlineExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// Error returned for writes of offline clients
+var errOffline = errors.New("objects read from files can't be modified")
+
+// NewOfflineClient returns a read-only client serving the Secrets (and
+// Namespaces) read from the given files and directories, so releases can be
+// analyzed without a cluster (like from "kubectl get secrets -o yaml" dumps or
+// backups). "-" reads from stdin. Objects found more than once (like in
+// overlapping backups) are served with their highest resourceVersion.
+func NewOfflineClient(scheme *runtime.Scheme, paths []string) (client.Client, error) {
+	c := &offlineClient{
+		scheme:  scheme,
+		mapper:  meta.NewDefaultRESTMapper(nil),
+		objects: map[offlineKey]client.Object{},
+	}
+	for _, path := range paths {
+		read, err := readOfflinePath(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range read {
+			c.add(obj)
+		}
+	}
+	return c, nil
+}
+
+type offlineKey struct {
+	kind string
+	types.NamespacedName
+}
+
+// offlineClient serves Secrets and Namespaces from memory
+type offlineClient struct {
+	scheme  *runtime.Scheme
+	mapper  meta.RESTMapper
+	objects map[offlineKey]client.Object
+}
+
+func newOfflineKey(obj client.Object) offlineKey {
+	kind := "Secret"
+	if _, ok := obj.(*corev1.Namespace); ok {
+		kind = "Namespace"
+	}
+	return offlineKey{kind: kind, NamespacedName: client.ObjectKeyFromObject(obj)}
+}
+
+// add adds obj unless a newer version of it has been added already
+func (c *offlineClient) add(obj client.Object) {
+	key := newOfflineKey(obj)
+	if existing, ok := c.objects[key]; ok {
+		a, errA := strconv.ParseUint(existing.GetResourceVersion(), 10, 64)
+		b, errB := strconv.ParseUint(obj.GetResourceVersion(), 10, 64)
+		if errA == nil && errB == nil && a > b {
+			return
+		}
+	}
+	c.objects[key] = obj
+}
+
+func (c *offlineClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		stored, ok := c.objects[offlineKey{kind: "Secret", NamespacedName: key}]
+		if !ok {
+			return apierrors.NewNotFound(corev1.Resource("secrets"), key.Name)
+		}
+		stored.(*corev1.Secret).DeepCopyInto(o)
+	case *corev1.Namespace:
+		stored, ok := c.objects[offlineKey{kind: "Namespace", NamespacedName: key}]
+		if !ok {
+			return apierrors.NewNotFound(corev1.Resource("namespaces"), key.Name)
+		}
+		stored.(*corev1.Namespace).DeepCopyInto(o)
+	default:
+		return fmt.Errorf("%T can't be read from files", obj)
+	}
+	return nil
+}
+
+func (c *offlineClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+	selector := listOpts.LabelSelector
+	if selector == nil && listOpts.Raw != nil && listOpts.Raw.LabelSelector != "" {
+		// Set by the helm storage driver
+		var err error
+		if selector, err = labels.Parse(listOpts.Raw.LabelSelector); err != nil {
+			return err
+		}
+	}
+	matches := func(obj client.Object) bool {
+		return (listOpts.Namespace == "" || obj.GetNamespace() == listOpts.Namespace) &&
+			(selector == nil || selector.Matches(labels.Set(obj.GetLabels())))
+	}
+	keys := make([]offlineKey, 0, len(c.objects))
+	for key := range c.objects {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Namespace != keys[j].Namespace {
+			return keys[i].Namespace < keys[j].Namespace
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	switch l := list.(type) {
+	case *corev1.SecretList:
+		l.Items = nil
+		for _, key := range keys {
+			if s, ok := c.objects[key].(*corev1.Secret); ok && matches(s) {
+				l.Items = append(l.Items, *s.DeepCopy())
+			}
+		}
+	case *corev1.NamespaceList:
+		l.Items = nil
+		for _, key := range keys {
+			if ns, ok := c.objects[key].(*corev1.Namespace); ok && matches(ns) {
+				l.Items = append(l.Items, *ns.DeepCopy())
+			}
+		}
+	default:
+		return fmt.Errorf("%T can't be read from files", list)
+	}
+	return nil
+}
+
+func (c *offlineClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return errOffline
+}
+
+func (c *offlineClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return errOffline
+}
+
+func (c *offlineClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return errOffline
+}
+
+func (c *offlineClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return errOffline
+}
+
+func (c *offlineClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	return errOffline
+}
+
+func (c *offlineClient) Status() client.StatusWriter {
+	return offlineStatusWriter{}
+}
+
+func (c *offlineClient) Scheme() *runtime.Scheme {
+	return c.scheme
+}
+
+func (c *offlineClient) RESTMapper() meta.RESTMapper {
+	return c.mapper
+}
+
+type offlineStatusWriter struct{}
+
+func (offlineStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return errOffline
+}
+
+func (offlineStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return errOffline
+}
+
+// readOfflinePath reads the objects of a file or of all YAML and JSON files in
+// a directory (recursively)
+func readOfflinePath(path string) ([]client.Object, error) {
+	if path == "-" {
+		return readOfflineObjects(os.Stdin, "stdin")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return readOfflineFile(path)
+	}
+	var objs []client.Object
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !offlineExtensions[strings.ToLower(filepath.Ext(p))] {
+			return err
+		}
+		read, err := readOfflineFile(p)
+		objs = append(objs, read...)
+		return err
+	})
+	return objs, err
+}
+
+func readOfflineFile(path string) ([]client.Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readOfflineObjects(f, path)
+}
+
+// readOfflineObjects reads the Secrets and Namespaces of a stream of YAML
+// documents or JSON objects, which may be Lists. Other kinds are skipped.
+func readOfflineObjects(r io.Reader, name string) ([]client.Object, error) {
+	var objs []client.Object
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var u unstructured.Unstructured
+		if err := decoder.Decode(&u.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objs, nil
+			}
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if len(u.Object) == 0 {
+			// Empty document
+			continue
+		}
+		items := []unstructured.Unstructured{u}
+		if u.IsList() {
+			list, err := u.ToList()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			items = list.Items
+		}
+		for _, item := range items {
+			var obj client.Object
+			switch item.GroupVersionKind() {
+			case corev1.SchemeGroupVersion.WithKind("Secret"):
+				obj = &corev1.Secret{}
+			case corev1.SchemeGroupVersion.WithKind("Namespace"):
+				obj = &corev1.Namespace{}
+			default:
+				continue
+			}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, obj); err != nil {
+				return nil, fmt.Errorf("%s: %s %s/%s: %w", name, item.GetKind(), item.GetNamespace(), item.GetName(), err)
+			}
+			objs = append(objs, obj)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+var _ = Describe("Offline client", func() {
+	ctx := context.Background()
+
+	// releaseSecrets returns the secrets of two revisions of a release
+	releaseSecrets := func() []corev1.Secret {
+		c := fake.NewClientBuilder().Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "offline"))
+		for revision, status := range []rspb.Status{rspb.StatusSuperseded, rspb.StatusDeployed} {
+			secretName, rel := newUnicorn("offunicorn", "offline", "offunicorn", "0.1.0", "1.0", revision+1, status)
+			Expect(driver.Create(secretName, rel)).To(Succeed())
+		}
+		var secrets corev1.SecretList
+		Expect(c.List(ctx, &secrets)).To(Succeed())
+		for i := range secrets.Items {
+			secrets.Items[i].APIVersion, secrets.Items[i].Kind = "v1", "Secret"
+		}
+		return secrets.Items
+	}
+
+	It("reads secrets from lists, multi-document YAML and directories", func() {
+		secrets := releaseSecrets()
+		dir := GinkgoT().TempDir()
+		Expect(os.Mkdir(filepath.Join(dir, "backup"), 0o755)).To(Succeed())
+
+		// kubectl get secrets -o json
+		list, err := json.Marshal(map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": []corev1.Secret{secrets[0]}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "backup", "secrets.json"), list, 0o644)).To(Succeed())
+		// Multiple documents, including other kinds and empty ones
+		doc, err := yaml.Marshal(secrets[1])
+		Expect(err).ToNot(HaveOccurred())
+		multi := "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: other\n  namespace: offline\n---\n" +
+			string(doc) + "---\n" + "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: offline\n---\n"
+		Expect(os.WriteFile(filepath.Join(dir, "dump.yaml"), []byte(multi), 0o644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "README.txt"), []byte("not a manifest"), 0o644)).To(Succeed())
+
+		c, err := NewOfflineClient(scheme.Scheme, []string{dir})
+		Expect(err).ToNot(HaveOccurred())
+		var read corev1.SecretList
+		Expect(c.List(ctx, &read, client.InNamespace("offline"))).To(Succeed())
+		Expect(read.Items).To(HaveLen(2))
+		var namespaces corev1.NamespaceList
+		Expect(c.List(ctx, &namespaces)).To(Succeed())
+		Expect(namespaces.Items).To(HaveLen(1))
+
+		r := &SecretReconciler{Client: c}
+		Expect(r.Snapshot(ctx, "")).To(Succeed())
+		Expect(getGaugeValue(metricRevision, "offunicorn", "offline")).To(Equal(2.0))
+		diff, err := DiffRevisions(ctx, c, "offline", "offunicorn", 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff).To(BeEmpty())
+	})
+	It("rejects writes", func() {
+		secrets := releaseSecrets()
+		path := filepath.Join(GinkgoT().TempDir(), "secret.yaml")
+		doc, err := yaml.Marshal(secrets[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(path, doc, 0o644)).To(Succeed())
+
+		c, err := NewOfflineClient(scheme.Scheme, []string{path})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Delete(ctx, &secrets[0])).To(MatchError(errOffline))
+		var read corev1.SecretList
+		Expect(c.List(ctx, &read)).To(Succeed())
+		Expect(read.Items).To(HaveLen(1))
+	})
+	It("serves the newest version of objects read more than once", func() {
+		secrets := releaseSecrets()
+		dir := GinkgoT().TempDir()
+		older, newer := secrets[1].DeepCopy(), secrets[1].DeepCopy()
+		older.ResourceVersion, older.Labels["status"] = "9", "pending-upgrade"
+		newer.ResourceVersion, newer.Labels["status"] = "10", "deployed"
+		// Overlapping backups, the newer one read first
+		for name, objs := range map[string][]corev1.Secret{
+			"a-2001-01-16.yaml": {secrets[0], *newer},
+			"b-2001-01-15.yaml": {secrets[0], *older},
+		} {
+			list, err := yaml.Marshal(map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": objs})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(dir, name), list, 0o644)).To(Succeed())
+		}
+
+		c, err := NewOfflineClient(scheme.Scheme, []string{dir})
+		Expect(err).ToNot(HaveOccurred())
+		var read corev1.SecretList
+		Expect(c.List(ctx, &read, client.MatchingLabels{"owner": "helm"})).To(Succeed())
+		Expect(read.Items).To(HaveLen(2))
+		var secret corev1.Secret
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(newer), &secret)).To(Succeed())
+		Expect(secret.ResourceVersion).To(Equal("10"))
+		Expect(secret.Labels["status"]).To(Equal("deployed"))
+
+		err = c.Get(ctx, types.NamespacedName{Name: "missing", Namespace: "offline"}, &secret)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+	It("rejects invalid files", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "broken.yaml")
+		Expect(os.WriteFile(path, []byte("kind: Secret\n  data: [\n"), 0o644)).To(Succeed())
+		_, err := NewOfflineClient(scheme.Scheme, []string{path})
+		Expect(err).To(MatchError(ContainSubstring(path)))
+
+		_, err = NewOfflineClient(scheme.Scheme, []string{"/does/not/exist"})
+		Expect(err).To(HaveOccurred())
+	})
+})
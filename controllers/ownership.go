@@ -0,0 +1,168 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ownershipIndex keeps track of which releases declare which objects in their
+// manifests.
+type ownershipIndex struct {
+	mu sync.Mutex
+	// objects maps object references to the releases declaring them
+	objects map[string]map[types.NamespacedName]bool
+	// releases maps releases to the object references in their manifest
+	releases map[types.NamespacedName][]string
+}
+
+func newOwnershipIndex() *ownershipIndex {
+	return &ownershipIndex{
+		objects:  map[string]map[types.NamespacedName]bool{},
+		releases: map[types.NamespacedName][]string{},
+	}
+}
+
+// objectRef returns a reference (like "Deployment.apps/default/foo") for an
+// object with the given key.
+func objectRef(obj *unstructured.Unstructured, key types.NamespacedName) string {
+	return obj.GroupVersionKind().GroupKind().String() + "/" + key.String()
+}
+
+// set replaces the objects declared by release. It returns all releases whose
+// number of duplicates might have changed, including release itself.
+func (i *ownershipIndex) set(release types.NamespacedName, refs []string) []types.NamespacedName {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	affected := i.removeLocked(release)
+	i.releases[release] = refs
+	for _, ref := range refs {
+		if i.objects[ref] == nil {
+			i.objects[ref] = map[types.NamespacedName]bool{}
+		}
+		i.objects[ref][release] = true
+		for other := range i.objects[ref] {
+			affected[other] = true
+		}
+	}
+	affected[release] = true
+	return keys(affected)
+}
+
+// remove forgets about a (deleted) release. It returns all releases whose number
+// of duplicates might have changed.
+func (i *ownershipIndex) remove(release types.NamespacedName) []types.NamespacedName {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	affected := i.removeLocked(release)
+	delete(affected, release)
+	return keys(affected)
+}
+
+func (i *ownershipIndex) removeLocked(release types.NamespacedName) map[types.NamespacedName]bool {
+	affected := map[types.NamespacedName]bool{}
+	for _, ref := range i.releases[release] {
+		delete(i.objects[ref], release)
+		for other := range i.objects[ref] {
+			affected[other] = true
+		}
+		if len(i.objects[ref]) == 0 {
+			delete(i.objects, ref)
+		}
+	}
+	delete(i.releases, release)
+	return affected
+}
+
+// duplicates returns the number of objects of release that are declared by
+// other releases as well.
+func (i *ownershipIndex) duplicates(release types.NamespacedName) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	count := 0
+	for _, ref := range i.releases[release] {
+		if len(i.objects[ref]) > 1 {
+			count++
+		}
+	}
+	return count
+}
+
+func keys(m map[types.NamespacedName]bool) []types.NamespacedName {
+	list := make([]types.NamespacedName, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	return list
+}
+
+// ownedObjects resolves the keys and references of all objects in a release
+// manifest. Objects of unknown kinds are skipped.
+func ownedObjects(mapper meta.RESTMapper, namespace string, objs []*unstructured.Unstructured) (map[string]*unstructured.Unstructured, map[string]types.NamespacedName, error) {
+	byRef := map[string]*unstructured.Unstructured{}
+	keys := map[string]types.NamespacedName{}
+	for _, obj := range objs {
+		key, err := objectKey(mapper, obj, namespace)
+		if err != nil {
+			if meta.IsNoMatchError(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		ref := objectRef(obj, key)
+		byRef[ref] = obj
+		keys[ref] = key
+	}
+	return byRef, keys, nil
+}
+
+// foreignOwnedObjects returns the number of live objects of a release manifest
+// whose helm annotations point to a different release.
+func foreignOwnedObjects(ctx context.Context, reader client.Reader, release types.NamespacedName, objs map[string]*unstructured.Unstructured, keys map[string]types.NamespacedName) (int, error) {
+	count := 0
+	for ref, obj := range objs {
+		live := &metav1.PartialObjectMetadata{}
+		live.SetGroupVersionKind(obj.GroupVersionKind())
+		if err := reader.Get(ctx, keys[ref], live); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return count, err
+		}
+		annotations := live.GetAnnotations()
+		name, namespace := annotations[annotationReleaseName], annotations[annotationReleaseNamespace]
+		// Objects created by helm < 3.2 don't carry the annotations
+		if name == "" && namespace == "" {
+			continue
+		}
+		if name != release.Name || namespace != release.Namespace {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Ownership index", func() {
+	punk := types.NamespacedName{Name: "punkunicorn", Namespace: "default"}
+	pink := types.NamespacedName{Name: "pinkunicorn", Namespace: "default"}
+
+	It("counts objects declared by multiple releases", func() {
+		i := newOwnershipIndex()
+		Expect(i.set(punk, []string{"ConfigMap/default/a", "Service/default/b"})).To(ConsistOf(punk))
+		Expect(i.duplicates(punk)).To(Equal(0))
+
+		Expect(i.set(pink, []string{"ConfigMap/default/a"})).To(ConsistOf(punk, pink))
+		Expect(i.duplicates(punk)).To(Equal(1))
+		Expect(i.duplicates(pink)).To(Equal(1))
+
+		// pink no longer declares the ConfigMap
+		Expect(i.set(pink, []string{"ConfigMap/default/c"})).To(ConsistOf(punk, pink))
+		Expect(i.duplicates(punk)).To(Equal(0))
+		Expect(i.duplicates(pink)).To(Equal(0))
+	})
+	It("updates other releases when a release is removed", func() {
+		i := newOwnershipIndex()
+		i.set(punk, []string{"ConfigMap/default/a"})
+		i.set(pink, []string{"ConfigMap/default/a"})
+		Expect(i.remove(pink)).To(ConsistOf(punk))
+		Expect(i.duplicates(punk)).To(Equal(0))
+	})
+})
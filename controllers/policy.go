@@ -0,0 +1,300 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultPolicySeverity = "warning"
+
+// PolicyConfig is the format of the policy configuration file
+type PolicyConfig struct {
+	// Disabled is a list of built-in rules not to evaluate
+	Disabled []string `json:"disabled,omitempty"`
+	// Severities overrides the severity of built-in rules
+	Severities map[string]string `json:"severities,omitempty"`
+	// Rules are evaluated in addition to the built-in rules
+	Rules []PolicyRuleConfig `json:"rules,omitempty"`
+}
+
+// PolicyRuleConfig defines a rule evaluated against every object in a manifest
+type PolicyRuleConfig struct {
+	Name     string `json:"name"`
+	Severity string `json:"severity,omitempty"`
+	// Kinds limits the rule to objects of the given kinds
+	Kinds []string `json:"kinds,omitempty"`
+	// JSONPath is evaluated against each object (like "{.spec.template.spec.containers[*].image}")
+	JSONPath string `json:"jsonpath"`
+	// Match is a regular expression. An object violates the rule if any of the
+	// JSONPath results matches.
+	Match string `json:"match,omitempty"`
+	// Absent makes an object violate the rule if the JSONPath has no result.
+	Absent bool `json:"absent,omitempty"`
+}
+
+// policyRule is a check of the objects of a release manifest
+type policyRule struct {
+	name     string
+	severity string
+	// violations returns the number of violations of the rule in objs
+	violations func(objs []*unstructured.Unstructured) int
+}
+
+// Policy is a set of rules deployed releases are checked against
+type Policy struct {
+	rules []policyRule
+}
+
+// policyResult is the result of evaluating a single rule
+type policyResult struct {
+	Rule       string
+	Severity   string
+	Violations int
+}
+
+// builtinPolicyRules returns the rules that are evaluated by default
+func builtinPolicyRules() []policyRule {
+	return []policyRule{
+		{name: "container-resource-limits", severity: "warning", violations: countContainers(func(c map[string]interface{}) bool {
+			limits, _, _ := unstructured.NestedMap(c, "resources", "limits")
+			return len(limits) == 0
+		})},
+		{name: "privileged-containers", severity: "critical", violations: countContainers(func(c map[string]interface{}) bool {
+			privileged, _, _ := unstructured.NestedBool(c, "securityContext", "privileged")
+			return privileged
+		})},
+		{name: "hostpath-volumes", severity: "warning", violations: countHostPathVolumes},
+		{name: "missing-pod-disruption-budget", severity: "warning", violations: countMissingPodDisruptionBudgets},
+	}
+}
+
+// NewPolicy returns a Policy with the built-in rules, modified and extended by
+// the configuration file at path (if not empty).
+func NewPolicy(path string) (*Policy, error) {
+	var config PolicyConfig
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			return nil, fmt.Errorf("unable to parse policy config %q: %w", path, err)
+		}
+	}
+
+	builtin := builtinPolicyRules()
+	names := map[string]bool{}
+	for _, rule := range builtin {
+		names[rule.name] = true
+	}
+	disabled := map[string]bool{}
+	for _, name := range config.Disabled {
+		if !names[name] {
+			return nil, fmt.Errorf("unable to disable unknown policy rule %q", name)
+		}
+		disabled[name] = true
+	}
+	for name := range config.Severities {
+		if !names[name] {
+			return nil, fmt.Errorf("unable to set the severity of unknown policy rule %q", name)
+		}
+	}
+	p := &Policy{}
+	for _, rule := range builtin {
+		if disabled[rule.name] {
+			continue
+		}
+		if severity, ok := config.Severities[rule.name]; ok {
+			rule.severity = severity
+		}
+		p.rules = append(p.rules, rule)
+	}
+	for _, rc := range config.Rules {
+		if names[rc.Name] {
+			return nil, fmt.Errorf("duplicate policy rule %q", rc.Name)
+		}
+		names[rc.Name] = true
+		rule, err := newJSONPathRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %q: %w", rc.Name, err)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// Evaluate checks objs against all rules of the policy.
+func (p *Policy) Evaluate(objs []*unstructured.Unstructured) []policyResult {
+	results := make([]policyResult, 0, len(p.rules))
+	for _, rule := range p.rules {
+		results = append(results, policyResult{
+			Rule:       rule.name,
+			Severity:   rule.severity,
+			Violations: rule.violations(objs),
+		})
+	}
+	return results
+}
+
+// newJSONPathRule creates a policyRule from its configuration
+func newJSONPathRule(rc PolicyRuleConfig) (policyRule, error) {
+	if rc.Name == "" {
+		return policyRule{}, fmt.Errorf("name is required")
+	}
+	if rc.Match == "" && !rc.Absent {
+		return policyRule{}, fmt.Errorf("one of match or absent is required")
+	}
+	if _, err := newValuePath(rc.JSONPath); err != nil {
+		return policyRule{}, err
+	}
+	var match *regexp.Regexp
+	if rc.Match != "" {
+		var err error
+		if match, err = regexp.Compile(rc.Match); err != nil {
+			return policyRule{}, err
+		}
+	}
+	kinds := map[string]bool{}
+	for _, k := range rc.Kinds {
+		kinds[k] = true
+	}
+	severity := rc.Severity
+	if severity == "" {
+		severity = defaultPolicySeverity
+	}
+
+	return policyRule{name: rc.Name, severity: severity, violations: func(objs []*unstructured.Unstructured) int {
+		// The JSONPath has been validated already
+		jp, _ := newValuePath(rc.JSONPath)
+		count := 0
+		for _, obj := range objs {
+			if len(kinds) > 0 && !kinds[obj.GetKind()] {
+				continue
+			}
+			results, err := jp.FindResults(obj.Object)
+			if err != nil {
+				continue
+			}
+			found := false
+			matched := false
+			for _, rs := range results {
+				for _, r := range rs {
+					found = true
+					if match != nil && match.MatchString(formatValue(r.Interface())) {
+						matched = true
+					}
+				}
+			}
+			if matched || (rc.Absent && !found) {
+				count++
+			}
+		}
+		return count
+	}}, nil
+}
+
+// countContainers returns a rule counting the containers fn returns true for
+func countContainers(fn func(container map[string]interface{}) bool) func([]*unstructured.Unstructured) int {
+	return func(objs []*unstructured.Unstructured) int {
+		count := 0
+		for _, obj := range objs {
+			spec, ok := podSpec(obj)
+			if !ok {
+				continue
+			}
+			for _, c := range podContainers(spec) {
+				if fn(c) {
+					count++
+				}
+			}
+		}
+		return count
+	}
+}
+
+func countHostPathVolumes(objs []*unstructured.Unstructured) int {
+	count := 0
+	for _, obj := range objs {
+		spec, ok := podSpec(obj)
+		if !ok {
+			continue
+		}
+		volumes, _, _ := unstructured.NestedSlice(spec, "volumes")
+		for _, v := range volumes {
+			if volume, ok := v.(map[string]interface{}); ok && volume["hostPath"] != nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// countMissingPodDisruptionBudgets counts the Deployments and StatefulSets with
+// more than one replica that are not selected by a PodDisruptionBudget of the
+// same manifest.
+func countMissingPodDisruptionBudgets(objs []*unstructured.Unstructured) int {
+	var selectors []labels.Selector
+	for _, obj := range objs {
+		if obj.GetKind() != "PodDisruptionBudget" {
+			continue
+		}
+		// A PodDisruptionBudget without selector selects no pods
+		selectorSpec, _, _ := unstructured.NestedMap(obj.Object, "spec", "selector")
+		if selectorSpec == nil {
+			continue
+		}
+		var ls metav1.LabelSelector
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(selectorSpec, &ls); err != nil {
+			continue
+		}
+		if selector, err := metav1.LabelSelectorAsSelector(&ls); err == nil {
+			selectors = append(selectors, selector)
+		}
+	}
+
+	count := 0
+	for _, obj := range objs {
+		if kind := obj.GetKind(); kind != "Deployment" && kind != "StatefulSet" {
+			continue
+		}
+		replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+		if !found || replicas < 2 {
+			continue
+		}
+		podLabels, _, _ := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "labels")
+		covered := false
+		for _, s := range selectors {
+			if s.Matches(labels.Set(podLabels)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			count++
+		}
+	}
+	return count
+}
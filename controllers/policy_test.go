@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const policyTestManifest = `---
+# Source: unicorn/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: unicorn
+spec:
+  replicas: 3
+  template:
+    metadata:
+      labels:
+        app: unicorn
+    spec:
+      containers:
+      - name: unicorn
+        image: unicorn:latest
+        securityContext:
+          privileged: true
+      - name: sidecar
+        image: sidecar:1.0
+        resources:
+          limits:
+            memory: 100Mi
+      volumes:
+      - name: data
+        hostPath:
+          path: /srv/data
+---
+# Source: unicorn/templates/empty.yaml
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: unicorn
+`
+
+func violationsByRule(results []policyResult) map[string]int {
+	violations := map[string]int{}
+	for _, r := range results {
+		violations[r.Rule] = r.Violations
+	}
+	return violations
+}
+
+var _ = Describe("Policy", func() {
+	It("checks manifests against the built-in rules", func() {
+		objs, err := parseManifest(policyTestManifest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs).To(HaveLen(2))
+
+		policy, err := NewPolicy("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violationsByRule(policy.Evaluate(objs))).To(Equal(map[string]int{
+			"container-resource-limits":     1,
+			"privileged-containers":         1,
+			"hostpath-volumes":              1,
+			"missing-pod-disruption-budget": 1,
+		}))
+	})
+	It("loads additional rules from a config file", func() {
+		config := filepath.Join(GinkgoT().TempDir(), "policy.yaml")
+		Expect(os.WriteFile(config, []byte(`
+disabled:
+- hostpath-volumes
+- missing-pod-disruption-budget
+severities:
+  privileged-containers: info
+rules:
+- name: latest-image-tag
+  kinds: [Deployment]
+  jsonpath: "{.spec.template.spec.containers[*].image}"
+  match: ":latest$"
+- name: missing-team-label
+  severity: info
+  jsonpath: .metadata.labels.team
+  absent: true
+`), 0644)).To(Succeed())
+
+		objs, err := parseManifest(policyTestManifest)
+		Expect(err).NotTo(HaveOccurred())
+		policy, err := NewPolicy(config)
+		Expect(err).NotTo(HaveOccurred())
+		results := policy.Evaluate(objs)
+		Expect(violationsByRule(results)).To(Equal(map[string]int{
+			"container-resource-limits": 1,
+			"privileged-containers":     1,
+			"latest-image-tag":          1,
+			"missing-team-label":        2,
+		}))
+		Expect(results).To(ContainElement(policyResult{Rule: "privileged-containers", Severity: "info", Violations: 1}))
+	})
+	It("reads PodDisruptionBudget selectors with expressions", func() {
+		objs, err := parseManifest(policyTestManifest + `---
+apiVersion: policy/v1
+kind: PodDisruptionBudget
+metadata:
+  name: unicorn
+spec:
+  minAvailable: 1
+  selector:
+    matchExpressions:
+    - key: app
+      operator: In
+      values: [unicorn, pegasus]
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(countMissingPodDisruptionBudgets(objs)).To(Equal(0))
+	})
+	It("rejects unknown and duplicate rules", func() {
+		for _, config := range []string{
+			"disabled: [no-such-rule]\n",
+			"severities:\n  no-such-rule: info\n",
+			"rules:\n- name: privileged-containers\n  jsonpath: .metadata.name\n",
+			"rules:\n- name: foo\n  jsonpath: .metadata.name\n- name: foo\n  jsonpath: .metadata.name\n",
+		} {
+			path := filepath.Join(GinkgoT().TempDir(), "policy.yaml")
+			Expect(os.WriteFile(path, []byte(config), 0644)).To(Succeed())
+			_, err := NewPolicy(path)
+			Expect(err).To(HaveOccurred(), config)
+		}
+	})
+})
@@ -0,0 +1,82 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// rollout is the rollout state of the latest revision of a release
+type rollout struct {
+	revision int
+	done     bool
+}
+
+// rolloutTracker keeps track of the rollouts of all releases
+type rolloutTracker struct {
+	mu       sync.Mutex
+	rollouts map[types.NamespacedName]*rollout
+}
+
+func newRolloutTracker() *rolloutTracker {
+	return &rolloutTracker{rollouts: map[types.NamespacedName]*rollout{}}
+}
+
+// update records whether the workloads of revision of a release are ready. It
+// returns whether the rollout is still in progress and, if the rollout just
+// finished, its duration counting from lastDeployed.
+// Helm stores pending revisions before applying their manifest, so the ready
+// workloads of a pending revision are still the ones of the previous revision.
+// Rollouts only finish once the revision is no longer pending.
+// Revisions that are already rolled out when first seen (e.g. on startup) are
+// not counted as finished rollouts.
+func (t *rolloutTracker) update(release types.NamespacedName, revision int, lastDeployed time.Time, pending, ready bool, now time.Time) (inProgress bool, duration time.Duration, finished bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, seen := t.rollouts[release]
+	if !seen || r.revision != revision {
+		r = &rollout{revision: revision, done: !seen && !pending && ready}
+		t.rollouts[release] = r
+	}
+	if r.done {
+		return false, 0, false
+	}
+	if pending || !ready {
+		return true, 0, false
+	}
+	r.done = true
+	return false, now.Sub(lastDeployed), true
+}
+
+// abort stops tracking the rollout of the current revision of a release (e.g.
+// because it failed).
+func (t *rolloutTracker) abort(release types.NamespacedName, revision int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollouts[release] = &rollout{revision: revision, done: true}
+}
+
+// forget removes all state of a (deleted) release.
+func (t *rolloutTracker) forget(release types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rollouts, release)
+}
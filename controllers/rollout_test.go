@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Rollout tracker", func() {
+	release := types.NamespacedName{Name: "punkunicorn", Namespace: "default"}
+	deployed := time.Date(2001, 1, 15, 19, 29, 0, 0, time.UTC)
+
+	It("does not count revisions that are ready when first seen", func() {
+		t := newRolloutTracker()
+		inProgress, _, finished := t.update(release, 1, deployed, false, true, deployed.Add(time.Hour))
+		Expect(inProgress).To(BeFalse())
+		Expect(finished).To(BeFalse())
+	})
+	It("measures the time until a new revision is ready", func() {
+		t := newRolloutTracker()
+		t.update(release, 1, deployed, false, true, deployed)
+
+		inProgress, _, finished := t.update(release, 2, deployed, false, false, deployed.Add(time.Minute))
+		Expect(inProgress).To(BeTrue())
+		Expect(finished).To(BeFalse())
+
+		inProgress, duration, finished := t.update(release, 2, deployed, false, true, deployed.Add(2*time.Minute))
+		Expect(inProgress).To(BeFalse())
+		Expect(finished).To(BeTrue())
+		Expect(duration).To(Equal(2 * time.Minute))
+
+		// A finished rollout is only counted once
+		_, _, finished = t.update(release, 2, deployed, false, true, deployed.Add(3*time.Minute))
+		Expect(finished).To(BeFalse())
+	})
+	It("does not finish rollouts of pending revisions", func() {
+		t := newRolloutTracker()
+		t.update(release, 1, deployed, false, true, deployed)
+
+		// The workloads of the previous revision are still ready
+		inProgress, _, finished := t.update(release, 2, deployed, true, true, deployed)
+		Expect(inProgress).To(BeTrue())
+		Expect(finished).To(BeFalse())
+
+		inProgress, _, finished = t.update(release, 2, deployed, false, false, deployed.Add(time.Minute))
+		Expect(inProgress).To(BeTrue())
+		Expect(finished).To(BeFalse())
+
+		inProgress, duration, finished := t.update(release, 2, deployed, false, true, deployed.Add(3*time.Minute))
+		Expect(inProgress).To(BeFalse())
+		Expect(finished).To(BeTrue())
+		Expect(duration).To(Equal(3 * time.Minute))
+	})
+	It("tracks pending revisions seen on startup", func() {
+		t := newRolloutTracker()
+		inProgress, _, _ := t.update(release, 2, deployed, true, true, deployed)
+		Expect(inProgress).To(BeTrue())
+		_, duration, finished := t.update(release, 2, deployed, false, true, deployed.Add(time.Minute))
+		Expect(finished).To(BeTrue())
+		Expect(duration).To(Equal(time.Minute))
+	})
+})
@@ -0,0 +1,49 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// hasSchema returns true if c or any of its subcharts ships a values.schema.json
+func hasSchema(c *chart.Chart) bool {
+	if c == nil {
+		return false
+	}
+	if len(c.Schema) > 0 {
+		return true
+	}
+	for _, d := range c.Dependencies() {
+		if hasSchema(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateValuesSchema validates the user supplied values merged with the chart
+// values against the values.schema.json of the chart (and its subcharts), the
+// same way helm does on install and upgrade.
+func validateValuesSchema(c *chart.Chart, config map[string]interface{}) error {
+	values, err := chartutil.CoalesceValues(c, config)
+	if err != nil {
+		return err
+	}
+	return chartutil.ValidateAgainstSchema(c, values)
+}
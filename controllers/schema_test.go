@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"helm.sh/helm/v3/pkg/chart"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Values schema validation", func() {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "unicorn", Version: "0.0.1"},
+		Values:   map[string]interface{}{"replicaCount": 1},
+		Schema: []byte(`{
+			"$schema": "http://json-schema.org/draft-07/schema#",
+			"type": "object",
+			"properties": {"replicaCount": {"type": "integer", "minimum": 1}},
+			"required": ["replicaCount"]
+		}`),
+	}
+
+	It("accepts valid values", func() {
+		Expect(hasSchema(c)).To(BeTrue())
+		Expect(validateValuesSchema(c, map[string]interface{}{"replicaCount": 3})).To(Succeed())
+		Expect(validateValuesSchema(c, nil)).To(Succeed())
+	})
+	It("reports the offending paths of invalid values", func() {
+		err := validateValuesSchema(c, map[string]interface{}{"replicaCount": "three"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("replicaCount"))
+	})
+	It("only validates deployed revisions", func() {
+		ctx := context.Background()
+		cl := fake.NewClientBuilder().Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(cl, "schema"))
+		for name, status := range map[string]rspb.Status{"deployedunicorn": rspb.StatusDeployed, "failedunicorn": rspb.StatusFailed} {
+			secretName, rel := newUnicorn(name, "schema", "unicorn", "0.0.1", "1.0", 1, status)
+			rel.Chart, rel.Config = c, map[string]interface{}{"replicaCount": "three"}
+			Expect(driver.Create(secretName, rel)).To(Succeed())
+		}
+
+		r := &SecretReconciler{Client: cl, ValidateSchema: true}
+		Expect(r.Snapshot(ctx, "schema")).To(Succeed())
+		Expect(getGaugeValue(metricSchemaValid, "deployedunicorn", "schema")).To(Equal(0.0))
+		Expect(testutil.CollectAndCount(metricSchemaValid)).To(Equal(1))
+	})
+})
@@ -19,20 +19,34 @@ package controllers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	helmrelease "helm.sh/helm/v3/pkg/release"
 	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	helmv1alpha1 "gerrit.wikimedia.org/r/operations/software/helm-state-metrics/api/v1alpha1"
 )
 
+// Labels the helm secrets storage driver uses for itself
+var helmDriverLabels = map[string]bool{"name": true, "owner": true, "status": true, "version": true}
+
 // Regex to extract the helm release name and revision from the secret name (in case of deletions)
 var reReleaseName = regexp.MustCompile(`^sh\.helm\.release\.v\d+\.([^\.]+)\.v(\d+)$`)
 
@@ -40,9 +54,92 @@ var reReleaseName = regexp.MustCompile(`^sh\.helm\.release\.v\d+\.([^\.]+)\.v(\d
 type SecretReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// InfoNamespaceLabels is the list of namespace label keys copied onto
+	// helm_release_info.
+	InfoNamespaceLabels []string
+	// ReleaseLabelsAllowlist is the list of helm release label keys (as set by
+	// "helm install --labels") exported as helm_release_labels.
+	ReleaseLabelsAllowlist []string
+	// ValuePaths is a list of JSONPath expressions evaluated against the values
+	// of a release and exported as helm_release_value(_info).
+	ValuePaths []string
+	// ValuePathsMerged evaluates ValuePaths against the chart values merged with
+	// the user supplied values instead of the user supplied values only.
+	ValuePathsMerged bool
+	// ScanSecrets enables scanning of release values for plaintext credentials.
+	ScanSecrets bool
+	// Policy is the set of rules the manifest of each release is checked
+	// against. Policy checks are disabled if nil.
+	Policy *Policy
+	// ValidateSchema enables validation of release values against the
+	// values.schema.json of the chart.
+	ValidateSchema bool
+	// DriftDetection enables comparing the objects in the manifest of deployed
+	// releases with the live objects every LiveObjectsInterval.
+	DriftDetection bool
+	// DriftIgnorePaths is a list of field paths (like ".spec.replicas" or
+	// "Deployment:.spec.replicas") not to compare during drift detection.
+	DriftIgnorePaths []string
+	// WorkloadHealth enables exporting the readiness of the workloads in the
+	// manifest of each release.
+	WorkloadHealth bool
+	// OwnershipConflicts enables detection of objects declared by multiple
+	// releases and of live objects whose helm annotations point to a different
+	// release (checked every LiveObjectsInterval).
+	OwnershipConflicts bool
+	// DeploymentWindows are the times deployments are allowed. Revisions
+	// deployed outside of them are reported if not nil.
+	DeploymentWindows *DeploymentWindows
+	// PendingTimeout is how long a revision may be pending before a
+	// pending_too_long transition is published. 0 disables the transition.
+	PendingTimeout time.Duration
+	// Events enables emitting Kubernetes Events for release transitions and
+	// release secrets that can't be decoded.
+	Events bool
+	// EventsObject is the object (like "configmap/helm-releases") in the
+	// namespace of a release Events are emitted for. Events are emitted for
+	// the latest release secret if empty.
+	EventsObject string
+	// ReleaseSummaries enables maintaining a HelmReleaseSummary object per
+	// release. Requires the HelmReleaseSummary CRD to be installed.
+	ReleaseSummaries bool
+	// AuditLog records every observed change of all revisions if not nil.
+	AuditLog *AuditLog
+	// Notifier sends release transitions to the configured notification sinks
+	// if not nil.
+	Notifier *Notifier
+	// LiveObjectsInterval is how often live objects are compared with release
+	// manifests.
+	LiveObjectsInterval time.Duration
+
+	// rollouts tracks the rollouts of all releases if WorkloadHealth is enabled
+	rollouts *rolloutTracker
+	// ownership tracks the objects declared by all releases if
+	// OwnershipConflicts is enabled
+	ownership *ownershipIndex
+	// history keeps the revisions of all releases
+	history *historyStore
+	// transitions publishes release transitions to API clients
+	transitions *transitionBroker
+	// recorder emits Kubernetes Events
+	recorder record.EventRecorder
+	// eventsObject is the resolved EventsObject
+	eventsObject *corev1.ObjectReference
+	// started is when the controller was set up. Events are only emitted for
+	// revisions deployed after.
+	started time.Time
+	// liveReader reads arbitrary objects from the API server. It is not cached,
+	// as the cache would start an informer for every kind of object released.
+	liveReader client.Reader
 }
 
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+//+kubebuilder:rbac:groups=helm.wikimedia.org,resources=helmreleasesummaries,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=helm.wikimedia.org,resources=helmreleasesummaries/status,verbs=get;update;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -88,17 +185,53 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 			// If the latest revision is deleted this means the full release has been deleted, so
 			// all metrics need to be removed.
 			metricInfo.DeletePartialMatch(prometheus.Labels{"name": releaseName, "namespace": req.Namespace, "revision": strconv.Itoa(releaseRevision)})
+			releaseKey := types.NamespacedName{Name: releaseName, Namespace: req.Namespace}
+			latest, known := r.history.latest(releaseKey)
+			r.history.remove(releaseKey, releaseRevision)
+			if r.AuditLog != nil {
+				r.AuditLog.forget(releaseKey, releaseRevision)
+			}
 			if releaseRevision == int(latestSeenReleaseRevision) {
+				if known && latest.Revision == releaseRevision {
+					r.publishTransition(ctx, transitionUninstalled, releaseKey, &latest, nil)
+				}
 				// latest release was deleted, clean up metrics
 				genericLabels := prometheus.Labels{"name": releaseName, "namespace": req.Namespace}
-				metricRevision.DeletePartialMatch(genericLabels)
-				metricStatus.DeletePartialMatch(genericLabels)
-				metricUpdated.DeletePartialMatch(genericLabels)
+				for _, m := range releaseMetrics() {
+					m.DeletePartialMatch(genericLabels)
+				}
+				metricDeployments.DeletePartialMatch(genericLabels)
+				metricRollbacks.DeletePartialMatch(genericLabels)
+				metricOutOfWindow.DeletePartialMatch(genericLabels)
+				metricAge.delete(releaseKey)
+				if err := r.deleteSummary(ctx, releaseKey); err != nil {
+					log.Error(err, "Unable to delete release summary")
+					metricErrors.WithLabelValues(req.Namespace).Inc()
+					return ctrl.Result{}, err
+				}
+				r.history.forget(releaseKey)
+				if r.rollouts != nil {
+					r.rollouts.forget(releaseKey)
+				}
+				if r.ownership != nil {
+					// Objects of other releases might no longer be duplicates
+					for _, other := range r.ownership.remove(releaseKey) {
+						metricOwnershipConflicts.WithLabelValues(other.Name, other.Namespace, "duplicate").Set(float64(r.ownership.duplicates(other)))
+					}
+				}
 			}
 			return ctrl.Result{}, nil
 		}
 		log.Error(err, "Unable to get release")
 		metricErrors.WithLabelValues(req.Namespace).Inc()
+		if r.Events {
+			// The secret exists, so it can't be decoded
+			var secret corev1.Secret
+			if r.Get(ctx, req.NamespacedName, &secret) == nil {
+				message := fmt.Sprintf("Unable to decode release secret %s: %v", req.Name, err)
+				r.emitEvent(req.Namespace, req.Name, corev1.EventTypeWarning, eventReasonDecodeError, message)
+			}
+		}
 		return ctrl.Result{}, err
 	}
 
@@ -109,6 +242,42 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	genericLabels := prometheus.Labels{"name": release.Name, "namespace": req.Namespace}
 	log = log.WithValues("namespace", req.Namespace, "release", release.Name, "chart", chartName, "chartVersion", chartVersion, "revision", releaseRevision, "status", release.Info.Status)
 
+	// All revisions (not only the latest one) are part of the release history
+	releaseKey := types.NamespacedName{Name: release.Name, Namespace: req.Namespace}
+	revision := newRevisionInfo(release)
+	update := r.history.observe(releaseKey, revision)
+	revision.RollbackTo = update.RollbackTo
+	if update.Result != "" {
+		metricDeployments.WithLabelValues(release.Name, req.Namespace, update.Result).Inc()
+	}
+	for _, d := range update.Restored {
+		metricTimeToRestore.WithLabelValues(req.Namespace).Observe(d.Seconds())
+	}
+	if update.Rollbacks > 0 {
+		metricRollbacks.With(genericLabels).Add(float64(update.Rollbacks))
+	}
+	var outOfWindow *windowViolation
+	if update.New && r.DeploymentWindows != nil {
+		outOfWindow = r.checkDeploymentWindow(ctx, req, release)
+	}
+	if r.AuditLog != nil {
+		if err := r.auditRevision(helmRelease, releaseKey, release, outOfWindow); err != nil {
+			log.Error(err, "Unable to write audit log")
+			metricErrors.WithLabelValues(req.Namespace).Inc()
+		}
+	}
+	if rate, ok := r.history.changeFailureRate(releaseKey); ok {
+		metricChangeFailureRate.With(genericLabels).Set(rate)
+	}
+	metricLastRollbackInfo.DeletePartialMatch(genericLabels)
+	if rollback, ok := r.history.lastRollback(releaseKey); ok {
+		metricLastRollback.With(genericLabels).Set(float64(rollback.Timestamp.Unix()))
+		metricLastRollbackInfo.WithLabelValues(release.Name, req.Namespace, strconv.Itoa(rollback.Revision),
+			strconv.Itoa(rollback.From), strconv.Itoa(rollback.To)).Set(1.0)
+	} else {
+		metricLastRollback.Delete(genericLabels)
+	}
+
 	// Get the latest release observed from the prometheus registry
 	latestSeenReleaseRevision, err := getGaugeValue(metricRevision, release.Name, req.Namespace)
 	if err != nil {
@@ -120,19 +289,80 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		log.WithValues("latestSeenReleaseRevision", latestSeenReleaseRevision).Info("Skipping as we've already seen a newer release")
 		return ctrl.Result{}, nil
 	}
-	if latestSeenReleaseRevision > 0.0 {
-		// This is a newer revision for an existing release, delete old info metric
-		metricInfo.DeletePartialMatch(genericLabels)
+	result := ctrl.Result{}
+	var previous *revisionInfo
+	if p, ok := r.history.previous(releaseKey, release.Version); ok {
+		previous = &p
+	}
+	// Transitions of revisions deployed before the controller started are
+	// history already.
+	if !update.New || !revision.LastDeployed.Before(r.started) {
+		if kind := transitionType(update.PreviousStatus, revision, previous); kind != "" {
+			r.publishTransition(ctx, kind, releaseKey, previous, &revision)
+		}
+	}
+	if release.Info.Status.IsPending() && r.PendingTimeout > 0 {
+		if pendingFor := time.Since(release.Info.LastDeployed.Time); pendingFor < r.PendingTimeout {
+			result.RequeueAfter = r.PendingTimeout - pendingFor
+		} else if r.history.reportPending(releaseKey, release.Version) {
+			r.publishTransition(ctx, transitionPendingTooLong, releaseKey, previous, &revision)
+		}
 	}
 
-	// Update the metrics in prometheus registry
-	metricInfo.WithLabelValues(release.Name, req.Namespace,
+	valuesHash, err := configHash(release.Config)
+	if err != nil {
+		log.Error(err, "Unable to hash release values")
+		metricErrors.WithLabelValues(req.Namespace).Inc()
+		return ctrl.Result{}, err
+	}
+
+	infoLabelValues := []string{release.Name, req.Namespace,
 		chartName,
 		chartVersion,
 		appVersion,
-		strconv.Itoa(release.Version)).Set(1.0)
+		strconv.Itoa(release.Version)}
+	if len(r.InfoNamespaceLabels) > 0 {
+		var ns corev1.Namespace
+		if err := r.Get(ctx, types.NamespacedName{Name: req.Namespace}, &ns); err != nil {
+			log.Error(err, "Unable to get namespace")
+			metricErrors.WithLabelValues(req.Namespace).Inc()
+			return ctrl.Result{}, err
+		}
+		infoLabelValues = append(infoLabelValues, labelValues(r.InfoNamespaceLabels, ns.Labels)...)
+	}
+
+	// The storage driver does not populate release.Labels on Get, so read them
+	// from the secret directly.
+	var secret corev1.Secret
+	if len(r.ReleaseLabelsAllowlist) > 0 {
+		if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+			log.Error(err, "Unable to get release secret")
+			metricErrors.WithLabelValues(req.Namespace).Inc()
+			return ctrl.Result{}, err
+		}
+	}
+
+	if latestSeenReleaseRevision > 0.0 {
+		// This is a newer (or the same) revision for an existing release, delete
+		// old revision metrics. This is done right before the new ones are set,
+		// so a failing reconcile does not leave the release without them.
+		for _, m := range revisionMetrics() {
+			m.DeletePartialMatch(genericLabels)
+		}
+	}
+
+	// Update the metrics in prometheus registry
+	metricInfo.WithLabelValues(infoLabelValues...).Set(1.0)
 	metricRevision.With(genericLabels).Set(releaseRevision)
+	metricHashInfo.WithLabelValues(release.Name, req.Namespace, valuesHash, manifestHash(release.Manifest)).Set(1.0)
 	metricUpdated.With(genericLabels).Set(float64(release.Info.LastDeployed.Unix()))
+	if !release.Info.FirstDeployed.IsZero() {
+		metricFirstDeployed.With(genericLabels).Set(float64(release.Info.FirstDeployed.Unix()))
+		metricAge.set(releaseKey, release.Info.FirstDeployed.Time)
+	}
+	if !release.Info.Deleted.IsZero() {
+		metricDeleted.With(genericLabels).Set(float64(release.Info.Deleted.Unix()))
+	}
 	// Send one metric per status
 	for _, s := range status {
 		value := 0.0
@@ -141,8 +371,162 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		}
 		metricStatus.WithLabelValues(release.Name, req.Namespace, s.String()).Set(value)
 	}
+	if len(r.ReleaseLabelsAllowlist) > 0 {
+		metricLabels.WithLabelValues(append([]string{release.Name, req.Namespace}, labelValues(r.ReleaseLabelsAllowlist, secret.Labels)...)...).Set(1.0)
+	}
+	if len(r.ValuePaths) > 0 {
+		values, err := releaseValues(release, r.ValuePathsMerged)
+		if err != nil {
+			log.Error(err, "Unable to merge release values")
+			metricErrors.WithLabelValues(req.Namespace).Inc()
+			return ctrl.Result{}, err
+		}
+		for _, path := range r.ValuePaths {
+			value, found, err := lookupValue(path, values)
+			if err != nil {
+				log.Error(err, "Unable to evaluate JSONPath", "path", path)
+				metricErrors.WithLabelValues(req.Namespace).Inc()
+				continue
+			}
+			if !found {
+				continue
+			}
+			if number, ok := value.(float64); ok {
+				metricValue.WithLabelValues(release.Name, req.Namespace, path).Set(number)
+			} else if isScalar(value) {
+				metricValueInfo.WithLabelValues(release.Name, req.Namespace, path, formatValue(value)).Set(1.0)
+			} else {
+				// Maps and lists would make for huge and unstable label values
+				log.V(1).Info("Not exporting non-scalar value", "path", path)
+			}
+		}
+	}
+	if r.ScanSecrets {
+		for _, path := range findSuspectedSecrets(release.Config) {
+			metricSuspectedSecret.WithLabelValues(release.Name, req.Namespace, path, "values").Set(1.0)
+		}
+		if release.Chart != nil {
+			for _, path := range findSuspectedSecrets(release.Chart.Values) {
+				metricSuspectedSecret.WithLabelValues(release.Name, req.Namespace, path, "chart_defaults").Set(1.0)
+			}
+		}
+	}
+	// Values of pending or failed revisions were possibly never validated by
+	// helm, so only the deployed revision is checked.
+	if r.ValidateSchema && release.Info.Status == helmrelease.StatusDeployed && hasSchema(release.Chart) {
+		valid := 1.0
+		if err := validateValuesSchema(release.Chart, release.Config); err != nil {
+			// The error lists all offending paths
+			log.Info("Release values do not validate against chart schema", "error", err.Error())
+			valid = 0.0
+		}
+		metricSchemaValid.With(genericLabels).Set(valid)
+	}
+
+	// The remaining metrics are generated from the objects in the release manifest
+	if !r.needsManifest() {
+		return result, r.updateSummary(ctx, req, release, nil, nil)
+	}
+	objs, err := parseManifest(release.Manifest)
+	if err != nil {
+		// Retrying won't help as the manifest won't change
+		log.Error(err, "Unable to parse release manifest")
+		metricErrors.WithLabelValues(req.Namespace).Inc()
+		return ctrl.Result{}, nil
+	}
+	if r.Policy != nil {
+		for _, result := range r.Policy.Evaluate(objs) {
+			metricPolicy.WithLabelValues(release.Name, req.Namespace, result.Rule, result.Severity).Set(float64(result.Violations))
+		}
+	}
+	// Health and drift of the release are part of its summary
+	var workloads *workloadsStatus
+	var drift *driftResult
+	if r.WorkloadHealth {
+		status, err := getWorkloadsStatus(ctx, r.Client, req.Namespace, objs)
+		if err != nil {
+			log.Error(err, "Unable to get workloads status")
+			metricErrors.WithLabelValues(req.Namespace).Inc()
+			return ctrl.Result{}, err
+		}
+		workloads = &status
+		metricWorkloadsReady.With(genericLabels).Set(float64(workloads.Ready))
+		metricWorkloadsTotal.With(genericLabels).Set(float64(workloads.Total))
+
+		if release.Info.Status == helmrelease.StatusFailed {
+			r.rollouts.abort(releaseKey, release.Version)
+			metricRolloutInProgress.With(genericLabels).Set(0.0)
+		} else if workloads.Total > 0 {
+			inProgress, duration, finished := r.rollouts.update(releaseKey, release.Version, release.Info.LastDeployed.Time,
+				release.Info.Status.IsPending(), workloads.Ready == workloads.Total, time.Now())
+			if finished {
+				log.Info("Rollout finished", "duration", duration)
+				metricRolloutDuration.WithLabelValues(chartName).Observe(duration.Seconds())
+			}
+			value := 0.0
+			if inProgress {
+				value = 1.0
+			}
+			metricRolloutInProgress.With(genericLabels).Set(value)
+		}
+	}
+	if r.DriftDetection {
+		metricDrifted.DeletePartialMatch(genericLabels)
+		metricMissing.DeletePartialMatch(genericLabels)
+		// Only the deployed revision is expected to match the cluster state
+		if release.Info.Status == helmrelease.StatusDeployed {
+			detected, err := detectDrift(ctx, r.liveReader, r.RESTMapper(), req.Namespace, objs, r.DriftIgnorePaths)
+			if err != nil {
+				log.Error(err, "Unable to detect drift")
+				metricErrors.WithLabelValues(req.Namespace).Inc()
+				return ctrl.Result{}, err
+			}
+			drift = &detected
+			for kind, count := range drift.Drifted {
+				metricDrifted.WithLabelValues(release.Name, req.Namespace, kind).Set(float64(count))
+			}
+			metricMissing.With(genericLabels).Set(float64(drift.Missing))
+			if len(drift.Errors) > 0 {
+				log.Info("Unable to read release resources, not comparing them", "errors", drift.Errors)
+				metricErrors.WithLabelValues(req.Namespace).Add(float64(len(drift.Errors)))
+			}
+			if len(drift.Details) > 0 {
+				log.V(1).Info("Release resources drifted", "drifted", drift.Details)
+			}
+		}
+	}
+	if r.OwnershipConflicts {
+		owned, keys, err := ownedObjects(r.RESTMapper(), req.Namespace, objs)
+		if err != nil {
+			log.Error(err, "Unable to resolve release objects")
+			metricErrors.WithLabelValues(req.Namespace).Inc()
+			return ctrl.Result{}, err
+		}
+		if release.Info.Status == helmrelease.StatusUninstalled {
+			// Releases uninstalled with --keep-history don't own objects anymore
+			owned = nil
+		}
+		refs := make([]string, 0, len(owned))
+		for ref := range owned {
+			refs = append(refs, ref)
+		}
+		for _, other := range r.ownership.set(releaseKey, refs) {
+			metricOwnershipConflicts.WithLabelValues(other.Name, other.Namespace, "duplicate").Set(float64(r.ownership.duplicates(other)))
+		}
+		foreign, err := foreignOwnedObjects(ctx, r.liveReader, releaseKey, owned, keys)
+		if err != nil {
+			log.Error(err, "Unable to check ownership of live objects")
+			metricErrors.WithLabelValues(req.Namespace).Inc()
+			return ctrl.Result{}, err
+		}
+		metricOwnershipConflicts.WithLabelValues(release.Name, req.Namespace, "annotation").Set(float64(foreign))
+	}
+	if (r.DriftDetection || r.OwnershipConflicts) && (result.RequeueAfter == 0 || r.LiveObjectsInterval < result.RequeueAfter) {
+		// Changes to the live objects are not watched, so check again later
+		result.RequeueAfter = r.LiveObjectsInterval
+	}
 
-	return ctrl.Result{}, nil
+	return result, r.updateSummary(ctx, req, release, workloads, drift)
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -152,8 +536,154 @@ func (r *SecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	if err != nil {
 		return err
 	}
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Secret{}).
-		WithEventFilter(pred).
-		Complete(r)
+	if err := r.setup(); err != nil {
+		return err
+	}
+	if r.Events || r.DeploymentWindows != nil {
+		r.recorder = mgr.GetEventRecorderFor("helm-state-metrics")
+	}
+	if r.EventsObject != "" {
+		if r.eventsObject, err = parseEventsObject(mgr.GetRESTMapper(), r.EventsObject); err != nil {
+			return err
+		}
+	}
+	if r.DriftDetection || r.OwnershipConflicts {
+		r.liveReader = mgr.GetAPIReader()
+	}
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Secret{}, builder.WithPredicates(pred))
+	if len(r.InfoNamespaceLabels) > 0 {
+		// Namespace labels are part of helm_release_info, so all releases in a
+		// namespace need to be reconciled when its labels change.
+		b = b.Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+				return r.releaseSecrets(obj.GetName(), "")
+			}),
+			builder.WithPredicates(predicate.LabelChangedPredicate{}))
+	}
+	if r.ReleaseSummaries {
+		// Changes to summaries are reverted
+		b = b.Owns(&helmv1alpha1.HelmReleaseSummary{})
+	}
+	if r.WorkloadHealth {
+		// Changes to the workloads of a release change its health
+		for _, newObj := range workloadKinds {
+			b = b.Watches(&source.Kind{Type: newObj()},
+				handler.EnqueueRequestsFromMapFunc(r.releaseSecretsForObject))
+		}
+	}
+	return b.Complete(r)
+}
+
+// setup prepares the reconciler independent of a manager
+func (r *SecretReconciler) setup() error {
+	if len(r.ReleaseLabelsAllowlist) > 0 {
+		var allowlist []string
+		for _, k := range r.ReleaseLabelsAllowlist {
+			if !helmDriverLabels[k] {
+				allowlist = append(allowlist, k)
+			}
+		}
+		r.ReleaseLabelsAllowlist = allowlist
+		registerReleaseLabels(allowlist)
+	}
+	for _, path := range r.ValuePaths {
+		if _, err := newValuePath(path); err != nil {
+			return fmt.Errorf("invalid JSONPath %q: %w", path, err)
+		}
+	}
+	r.history = newHistoryStore()
+	r.transitions = newTransitionBroker()
+	r.started = time.Now()
+	if len(r.InfoNamespaceLabels) > 0 {
+		setInfoLabelKeys(r.InfoNamespaceLabels)
+	}
+	if r.WorkloadHealth {
+		r.rollouts = newRolloutTracker()
+	}
+	if r.OwnershipConflicts {
+		r.ownership = newOwnershipIndex()
+	}
+	return nil
+}
+
+// checkDeploymentWindow counts revisions deployed outside of the allowed
+// windows. For revisions deployed after the controller started, a Warning
+// Event is emitted and the violation is returned, so it can be added to the
+// audit log record of the revision.
+func (r *SecretReconciler) checkDeploymentWindow(ctx context.Context, req ctrl.Request, release *helmrelease.Release) *windowViolation {
+	deployed := release.Info.LastDeployed.Time
+	violation, violated := r.DeploymentWindows.Check(req.Namespace, deployed)
+	if !violated {
+		return nil
+	}
+	metricOutOfWindow.WithLabelValues(release.Name, req.Namespace, violation.Reason).Inc()
+	if deployed.Before(r.started) {
+		return nil
+	}
+
+	message := fmt.Sprintf("Revision %d of release %s was deployed outside of the allowed deployment windows", release.Version, release.Name)
+	if violation.Reason == windowReasonFreeze {
+		message = fmt.Sprintf("Revision %d of release %s was deployed during a deployment freeze", release.Version, release.Name)
+		if violation.Detail != "" {
+			message += ": " + violation.Detail
+		}
+	}
+	log.FromContext(ctx).WithName("audit").Info(message,
+		"namespace", req.Namespace, "release", release.Name, "revision", release.Version,
+		"lastDeployed", deployed, "reason", violation.Reason, "detail", violation.Detail)
+
+	r.emitEvent(req.Namespace, req.Name, corev1.EventTypeWarning, eventReasonOutOfWindowDeployment, message)
+	return &violation
+}
+
+// needsManifest returns true if any of the enabled features needs the objects
+// of the release manifest.
+func (r *SecretReconciler) needsManifest() bool {
+	return r.Policy != nil || r.DriftDetection || r.WorkloadHealth || r.OwnershipConflicts
+}
+
+// releaseSecretsForObject returns a reconcile request for the latest secret of
+// the helm release the given object belongs to (according to its helm
+// annotations).
+func (r *SecretReconciler) releaseSecretsForObject(obj client.Object) []reconcile.Request {
+	annotations := obj.GetAnnotations()
+	name, namespace := annotations[annotationReleaseName], annotations[annotationReleaseNamespace]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return r.releaseSecrets(namespace, name)
+}
+
+// releaseSecrets returns reconcile requests for the latest secret of all helm
+// releases in the given namespace, limited to the given release if name is not
+// empty. Older revisions are skipped by Reconcile anyways.
+func (r *SecretReconciler) releaseSecrets(namespace, name string) []reconcile.Request {
+	matchingLabels := client.MatchingLabels{"owner": "helm"}
+	if name != "" {
+		matchingLabels["name"] = name
+	}
+	var secrets corev1.SecretList
+	if err := r.List(context.Background(), &secrets, client.InNamespace(namespace), matchingLabels); err != nil {
+		log.Log.Error(err, "Unable to list helm release secrets", "namespace", namespace, "release", name)
+		return nil
+	}
+	latest := map[string]corev1.Secret{}
+	for _, s := range secrets.Items {
+		version, err := strconv.Atoi(s.Labels["version"])
+		if err != nil {
+			continue
+		}
+		if l, ok := latest[s.Labels["name"]]; ok {
+			if latestVersion, _ := strconv.Atoi(l.Labels["version"]); latestVersion > version {
+				continue
+			}
+		}
+		latest[s.Labels["name"]] = s
+	}
+	requests := make([]reconcile.Request, 0, len(latest))
+	for _, s := range latest {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: s.Name, Namespace: s.Namespace}})
+	}
+	return requests
 }
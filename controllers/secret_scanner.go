@@ -0,0 +1,107 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// Keys that are likely to hold credentials
+	reSecretKey = regexp.MustCompile(`(?i)(passw(or)?d|token|secret|credential|private.?key|api.?key|access.?key|auth)`)
+	// Keys that are likely to reference credentials stored elsewhere
+	reSecretRefKey = regexp.MustCompile(`(?i)(^existing|(name|ref|file|path|enabled|mount|dir|ttl|length|url)$)`)
+	// Values that are not credentials even if the key suggests otherwise
+	reNonSecretValue = regexp.MustCompile(`^(\{\{.*\}\}|\$\{.*\}|true|false|yes|no|null|changeme|[0-9.]+|sha256:[0-9a-f]{64}|[0-9a-f]{40}|[0-9a-f]{64})$`)
+)
+
+const (
+	// Minimum length of values with suspicious keys
+	minSecretKeyValueLength = 6
+	// Minimum length and Shannon entropy (bits per character) of values to be
+	// suspected secrets independent of their key
+	minHighEntropyLength  = 24
+	minHighEntropyPerChar = 4.2
+)
+
+// findSuspectedSecrets walks values and returns the (sorted) paths of string
+// values that look like plaintext credentials. The values themselves are never
+// returned.
+func findSuspectedSecrets(values map[string]interface{}) []string {
+	found := map[string]bool{}
+	walkValues("", "", values, func(path, key, value string) {
+		if isSuspectedSecret(key, value) {
+			found[path] = true
+		}
+	})
+	paths := make([]string, 0, len(found))
+	for p := range found {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// walkValues calls fn for every string leaf in v with its JSONPath-like path
+// (e.g. ".database.password" or ".users[0].token") and the closest map key.
+func walkValues(path, key string, v interface{}, fn func(path, key, value string)) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			walkValues(path+"."+k, k, e, fn)
+		}
+	case []interface{}:
+		for i, e := range v {
+			walkValues(fmt.Sprintf("%s[%d]", path, i), key, e, fn)
+		}
+	case string:
+		fn(path, key, v)
+	}
+}
+
+// isSuspectedSecret uses key name heuristics and the entropy of value to decide
+// whether value is likely a plaintext credential.
+func isSuspectedSecret(key, value string) bool {
+	value = strings.TrimSpace(value)
+	if value == "" || reNonSecretValue.MatchString(strings.ToLower(value)) {
+		return false
+	}
+	if reSecretKey.MatchString(key) && !reSecretRefKey.MatchString(key) && len(value) >= minSecretKeyValueLength {
+		return true
+	}
+	return len(value) >= minHighEntropyLength && !strings.ContainsAny(value, " \n/") && shannonEntropy(value) >= minHighEntropyPerChar
+}
+
+// shannonEntropy returns the Shannon entropy of s in bits per character.
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	n := 0
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Secret scanner", func() {
+	It("finds values that look like credentials", func() {
+		values := map[string]interface{}{
+			"database": map[string]interface{}{
+				"host":     "db.example.org",
+				"password": "hunter22",
+			},
+			"users": []interface{}{
+				map[string]interface{}{"name": "bob", "apiToken": "abcdefgh"},
+			},
+			"webhook": "Zm9vYmFyYmF6cXV4MTIzNDU2Nzg5MEFCQ0RFRkdISUpLTE1O",
+		}
+		Expect(findSuspectedSecrets(values)).To(Equal([]string{".database.password", ".users[0].apiToken", ".webhook"}))
+	})
+	It("ignores references to credentials and placeholders", func() {
+		values := map[string]interface{}{
+			"existingSecret":  "my-secret",
+			"secretName":      "my-secret",
+			"passwordFile":    "/etc/secrets/password",
+			"token":           "{{ .Values.global.token }}",
+			"auth":            map[string]interface{}{"enabled": "true"},
+			"imageDigest":     "sha256:8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4",
+			"description":     "The password used to access the database",
+			"tokenTTLSeconds": "3600",
+		}
+		Expect(findSuspectedSecrets(values)).To(BeEmpty())
+	})
+})
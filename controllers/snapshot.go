@@ -0,0 +1,90 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Snapshot reconciles all helm release secrets in namespace (or all namespaces
+// if empty) once, without a manager. Afterwards the metrics registry holds the
+// same metrics the controller would export. Releases that could not be
+// reconciled are counted in helm_release_errors and reported as error.
+func (r *SecretReconciler) Snapshot(ctx context.Context, namespace string) error {
+	if err := r.setup(); err != nil {
+		return err
+	}
+	if r.DriftDetection || r.OwnershipConflicts {
+		r.liveReader = r.Client
+	}
+
+	var secrets corev1.SecretList
+	if err := r.List(ctx, &secrets, client.InNamespace(namespace), client.MatchingLabels{"owner": "helm"}); err != nil {
+		return err
+	}
+	// Revisions are reconciled oldest first, like they have been deployed
+	sort.Slice(secrets.Items, func(i, j int) bool {
+		a, b := secrets.Items[i], secrets.Items[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Labels["name"] != b.Labels["name"] {
+			return a.Labels["name"] < b.Labels["name"]
+		}
+		va, errA := strconv.Atoi(a.Labels["version"])
+		vb, errB := strconv.Atoi(b.Labels["version"])
+		if errA != nil || errB != nil {
+			return a.Name < b.Name
+		}
+		return va < vb
+	})
+
+	failed := 0
+	for _, s := range secrets.Items {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: s.Name, Namespace: s.Namespace}}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("unable to reconcile %d of %d release secrets", failed, len(secrets.Items))
+	}
+	return nil
+}
+
+// Snapshot reconciles all namespaces once, without a manager
+func (r *NamespaceReconciler) Snapshot(ctx context.Context) error {
+	registerNamespaceLabels(r.LabelsAllowlist)
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces); err != nil {
+		return err
+	}
+	for _, ns := range namespaces.Items {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
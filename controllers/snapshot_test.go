@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	helmtime "helm.sh/helm/v3/pkg/time"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// unavailableNamespacesClient fails to read Namespaces
+type unavailableNamespacesClient struct {
+	client.Client
+}
+
+func (c unavailableNamespacesClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if _, ok := obj.(*corev1.Namespace); ok {
+		return apierrors.NewServiceUnavailable("try again")
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+var _ = Describe("Snapshot", func() {
+	ctx := context.Background()
+
+	It("reconciles all revisions oldest first", func() {
+		c := fake.NewClientBuilder().Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "snapshot"))
+		// Revision 10 sorts before revision 2 by name
+		for _, revision := range []int{2, 10} {
+			status := rspb.StatusSuperseded
+			if revision == 10 {
+				status = rspb.StatusDeployed
+			}
+			secretName, rel := newUnicorn("snapunicorn", "snapshot", "snapunicorn", "0.1.0", "1.0", revision, status)
+			Expect(driver.Create(secretName, rel)).To(Succeed())
+		}
+		r := &SecretReconciler{Client: c}
+		Expect(r.Snapshot(ctx, "")).To(Succeed())
+		Expect(getGaugeValue(metricRevision, "snapunicorn", "snapshot")).To(Equal(10.0))
+		Expect(testutil.ToFloat64(metricStatus.WithLabelValues("snapunicorn", "snapshot", "deployed"))).To(Equal(1.0))
+		Expect(r.history.history(types.NamespacedName{Name: "snapunicorn", Namespace: "snapshot"})).To(HaveLen(2))
+	})
+	It("reports releases that can't be decoded", func() {
+		corrupt := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "sh.helm.release.v1.broken.v1", Namespace: "snapshot-broken",
+				Labels: map[string]string{"owner": "helm", "name": "broken", "version": "1"}},
+			Data: map[string][]byte{"release": []byte("not a release")},
+		}
+		c := fake.NewClientBuilder().WithObjects(corrupt).Build()
+		before := testutil.ToFloat64(metricErrors.WithLabelValues("snapshot-broken"))
+		r := &SecretReconciler{Client: c}
+		Expect(r.Snapshot(ctx, "snapshot-broken")).To(MatchError("unable to reconcile 1 of 1 release secrets"))
+		Expect(testutil.ToFloat64(metricErrors.WithLabelValues("snapshot-broken"))).To(Equal(before + 1))
+	})
+	It("counts deployments outside of the allowed windows without emitting Events", func() {
+		config := filepath.Join(GinkgoT().TempDir(), "windows.yaml")
+		Expect(os.WriteFile(config, []byte(fmt.Sprintf(`
+freezes:
+  - start: %q
+    end: %q
+`, time.Now().AddDate(0, 0, -1).Format("2006-01-02"), time.Now().AddDate(0, 0, 2).Format("2006-01-02"))), 0o644)).To(Succeed())
+		windows, err := NewDeploymentWindows(config)
+		Expect(err).ToNot(HaveOccurred())
+		c := fake.NewClientBuilder().Build()
+		secretName, rel := newUnicorn("frozenunicorn", "snapshot-windows", "frozenunicorn", "0.1.0", "1.0", 1, rspb.StatusDeployed)
+		// Deployed after the snapshot started
+		rel.Info.LastDeployed = helmtime.Now().Add(time.Hour)
+		Expect(helmStorageDriver.NewSecrets(NewSecretsClient(c, "snapshot-windows")).Create(secretName, rel)).To(Succeed())
+
+		r := &SecretReconciler{Client: c, DeploymentWindows: windows}
+		Expect(r.Snapshot(ctx, "snapshot-windows")).To(Succeed())
+		Expect(testutil.ToFloat64(metricOutOfWindow.WithLabelValues("frozenunicorn", "snapshot-windows", "freeze"))).To(Equal(1.0))
+
+		// Uninstalling the release removes the counter
+		exported := testutil.CollectAndCount(metricOutOfWindow)
+		Expect(c.Delete(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: "snapshot-windows"}})).To(Succeed())
+		_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: secretName, Namespace: "snapshot-windows"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(testutil.CollectAndCount(metricOutOfWindow)).To(Equal(exported - 1))
+	})
+	It("keeps the metrics of a new revision that fails to reconcile", func() {
+		c := fake.NewClientBuilder().WithObjects(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name: "snapshot-failing", Labels: map[string]string{"team": "sre"}}}).Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "snapshot-failing"))
+		secretName, rel := newUnicorn("failingunicorn", "snapshot-failing", "failingunicorn", "0.1.0", "1.0", 1, rspb.StatusDeployed)
+		Expect(driver.Create(secretName, rel)).To(Succeed())
+		r := &SecretReconciler{Client: c, InfoNamespaceLabels: []string{"team"}}
+		Expect(r.Snapshot(ctx, "snapshot-failing")).To(Succeed())
+		defer setInfoLabelKeys(nil)
+
+		secretName, rel = newUnicorn("failingunicorn", "snapshot-failing", "failingunicorn", "0.2.0", "1.0", 2, rspb.StatusDeployed)
+		Expect(driver.Create(secretName, rel)).To(Succeed())
+		r.Client = unavailableNamespacesClient{c}
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: secretName, Namespace: "snapshot-failing"}})
+		Expect(err).To(HaveOccurred())
+		// The metrics of the previous revision are kept until the new ones can be set
+		Expect(testutil.ToFloat64(metricInfo.WithLabelValues("failingunicorn", "snapshot-failing", "failingunicorn", "0.1.0", "1.0", "1", "sre"))).To(Equal(1.0))
+	})
+	It("tells user supplied from chart default suspected secrets", func() {
+		c := fake.NewClientBuilder().Build()
+		secretName, rel := newUnicorn("scanunicorn", "snapshot-scan", "scanunicorn", "0.1.0", "1.0", 1, rspb.StatusDeployed)
+		rel.Config = map[string]interface{}{"database": map[string]interface{}{"password": "hunter22"}}
+		rel.Chart.Values = map[string]interface{}{"auth": map[string]interface{}{"token": "correcthorsebattery"}}
+		Expect(helmStorageDriver.NewSecrets(NewSecretsClient(c, "snapshot-scan")).Create(secretName, rel)).To(Succeed())
+
+		r := &SecretReconciler{Client: c, ScanSecrets: true}
+		Expect(r.Snapshot(ctx, "snapshot-scan")).To(Succeed())
+		Expect(testutil.ToFloat64(metricSuspectedSecret.WithLabelValues("scanunicorn", "snapshot-scan", ".database.password", "values"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metricSuspectedSecret.WithLabelValues("scanunicorn", "snapshot-scan", ".auth.token", "chart_defaults"))).To(Equal(1.0))
+	})
+})
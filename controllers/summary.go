@@ -0,0 +1,177 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	helmrelease "helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	helmv1alpha1 "gerrit.wikimedia.org/r/operations/software/helm-state-metrics/api/v1alpha1"
+)
+
+// Reason of conditions that have not been checked
+const conditionReasonNotChecked = "NotChecked"
+
+// conditionReason returns a helm status (like "pending-upgrade") as CamelCase
+// condition reason (like "PendingUpgrade").
+func conditionReason(status helmrelease.Status) string {
+	var reason strings.Builder
+	for _, word := range strings.Split(status.String(), "-") {
+		if word != "" {
+			reason.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	if reason.Len() == 0 {
+		return "Unknown"
+	}
+	return reason.String()
+}
+
+// summaryTime returns t as it is stored in the API (with second precision) or
+// nil if t is zero.
+func summaryTime(t time.Time) *metav1.Time {
+	if t.IsZero() {
+		return nil
+	}
+	mt := metav1.NewTime(t.Truncate(time.Second))
+	return &mt
+}
+
+// summaryStatus returns the status of the HelmReleaseSummary of release.
+// workloads and drift are nil if they have not been checked.
+func summaryStatus(release *helmrelease.Release, workloads *workloadsStatus, drift *driftResult) helmv1alpha1.HelmReleaseSummaryStatus {
+	status := helmv1alpha1.HelmReleaseSummaryStatus{
+		Chart:         formatChartName(release.Chart),
+		ChartVersion:  formatChartVersion(release.Chart),
+		AppVersion:    formatAppVersion(release.Chart),
+		Status:        release.Info.Status.String(),
+		Revision:      release.Version,
+		Description:   release.Info.Description,
+		FirstDeployed: summaryTime(release.Info.FirstDeployed.Time),
+		LastDeployed:  summaryTime(release.Info.LastDeployed.Time),
+		Deleted:       summaryTime(release.Info.Deleted.Time),
+	}
+
+	deployed := metav1.Condition{Type: helmv1alpha1.ConditionDeployed, Status: metav1.ConditionFalse,
+		Reason: conditionReason(release.Info.Status), Message: release.Info.Description}
+	if release.Info.Status == helmrelease.StatusDeployed {
+		deployed.Status = metav1.ConditionTrue
+	}
+	healthy := metav1.Condition{Type: helmv1alpha1.ConditionHealthy, Status: metav1.ConditionUnknown,
+		Reason: conditionReasonNotChecked, Message: "Workload health checks are disabled"}
+	if workloads != nil {
+		healthy.Status, healthy.Reason = metav1.ConditionTrue, "WorkloadsReady"
+		if workloads.Ready < workloads.Total {
+			healthy.Status, healthy.Reason = metav1.ConditionFalse, "WorkloadsNotReady"
+		}
+		healthy.Message = fmt.Sprintf("%d of %d workloads ready", workloads.Ready, workloads.Total)
+	}
+	drifted := metav1.Condition{Type: helmv1alpha1.ConditionDrifted, Status: metav1.ConditionUnknown,
+		Reason: conditionReasonNotChecked, Message: "Drift detection is disabled or the release is not deployed"}
+	if drift != nil {
+		count := 0
+		for _, n := range drift.Drifted {
+			count += n
+		}
+		drifted.Status, drifted.Reason = metav1.ConditionFalse, "InSync"
+		if count > 0 || drift.Missing > 0 {
+			drifted.Status, drifted.Reason = metav1.ConditionTrue, "ResourcesDrifted"
+		}
+		drifted.Message = fmt.Sprintf("%d objects drifted, %d missing", count, drift.Missing)
+	}
+	status.Conditions = []metav1.Condition{deployed, healthy, drifted}
+	return status
+}
+
+// updateSummary creates or updates the HelmReleaseSummary of release (read
+// from the secret req) if ReleaseSummaries is enabled. The summary is owned by
+// the secret, so it is garbage collected with the release.
+func (r *SecretReconciler) updateSummary(ctx context.Context, req ctrl.Request, release *helmrelease.Release, workloads *workloadsStatus, drift *driftResult) error {
+	if !r.ReleaseSummaries {
+		return nil
+	}
+	err := r.applySummary(ctx, req, release, workloads, drift)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Unable to update release summary")
+		metricErrors.WithLabelValues(req.Namespace).Inc()
+	}
+	return err
+}
+
+func (r *SecretReconciler) applySummary(ctx context.Context, req ctrl.Request, release *helmrelease.Release, workloads *workloadsStatus, drift *driftResult) error {
+	var secret corev1.Secret
+	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	owner := *metav1.NewControllerRef(&secret, corev1.SchemeGroupVersion.WithKind("Secret"))
+
+	var summary helmv1alpha1.HelmReleaseSummary
+	err := r.Get(ctx, types.NamespacedName{Name: release.Name, Namespace: req.Namespace}, &summary)
+	if apierrors.IsNotFound(err) {
+		summary = helmv1alpha1.HelmReleaseSummary{ObjectMeta: metav1.ObjectMeta{
+			Name:            release.Name,
+			Namespace:       req.Namespace,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		}}
+		if err := r.Create(ctx, &summary); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if !equality.Semantic.DeepEqual(summary.OwnerReferences, []metav1.OwnerReference{owner}) {
+		// Owned by the secret of the latest revision
+		summary.OwnerReferences = []metav1.OwnerReference{owner}
+		if err := r.Update(ctx, &summary); err != nil {
+			return err
+		}
+	}
+
+	status := summaryStatus(release, workloads, drift)
+	conditions := append([]metav1.Condition(nil), summary.Status.Conditions...)
+	for _, c := range status.Conditions {
+		// Keeps the transition time of unchanged conditions
+		meta.SetStatusCondition(&conditions, c)
+	}
+	status.Conditions = conditions
+	if equality.Semantic.DeepEqual(summary.Status, status) {
+		return nil
+	}
+	summary.Status = status
+	return r.Status().Update(ctx, &summary)
+}
+
+// deleteSummary deletes the HelmReleaseSummary of a deleted release
+func (r *SecretReconciler) deleteSummary(ctx context.Context, release types.NamespacedName) error {
+	if !r.ReleaseSummaries {
+		return nil
+	}
+	summary := helmv1alpha1.HelmReleaseSummary{ObjectMeta: metav1.ObjectMeta{Name: release.Name, Namespace: release.Namespace}}
+	return client.IgnoreNotFound(r.Delete(ctx, &summary))
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	helmv1alpha1 "gerrit.wikimedia.org/r/operations/software/helm-state-metrics/api/v1alpha1"
+)
+
+var _ = Describe("Release summaries", func() {
+	var r *SecretReconciler
+	var c client.Client
+	release := types.NamespacedName{Name: "punkunicorn", Namespace: "default"}
+	ctx := context.Background()
+
+	getSummary := func() (helmv1alpha1.HelmReleaseSummary, error) {
+		var summary helmv1alpha1.HelmReleaseSummary
+		err := c.Get(ctx, release, &summary)
+		return summary, err
+	}
+
+	BeforeEach(func() {
+		s := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(helmv1alpha1.AddToScheme(s)).To(Succeed())
+		c = fake.NewClientBuilder().WithScheme(s).Build()
+		r = &SecretReconciler{Client: c, ReleaseSummaries: true}
+	})
+
+	It("mirrors the latest revision of a release", func() {
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "default"))
+		secretName, rel := newUnicorn("punkunicorn", "default", "punkunicorn", "0.1.0", "1.0", 1, rspb.StatusPendingInstall)
+		Expect(driver.Create(secretName, rel)).To(Succeed())
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: secretName, Namespace: "default"}}
+
+		Expect(r.updateSummary(ctx, req, rel, nil, nil)).To(Succeed())
+		summary, err := getSummary()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(summary.OwnerReferences).To(HaveLen(1))
+		Expect(summary.OwnerReferences[0].Name).To(Equal(secretName))
+		Expect(summary.Status.Chart).To(Equal("punkunicorn"))
+		Expect(summary.Status.Revision).To(Equal(1))
+		Expect(summary.Status.LastDeployed.Time).To(BeTemporally("==", rel.Info.LastDeployed.Time))
+		Expect(summary.Status.FirstDeployed).To(BeNil())
+		deployed := meta.FindStatusCondition(summary.Status.Conditions, helmv1alpha1.ConditionDeployed)
+		Expect(deployed.Status).To(Equal(metav1.ConditionFalse))
+		Expect(deployed.Reason).To(Equal("PendingInstall"))
+		Expect(meta.IsStatusConditionPresentAndEqual(summary.Status.Conditions, helmv1alpha1.ConditionHealthy, metav1.ConditionUnknown)).To(BeTrue())
+
+		rel.Info.Status = rspb.StatusDeployed
+		Expect(r.updateSummary(ctx, req, rel, &workloadsStatus{Ready: 1, Total: 2}, &driftResult{Drifted: map[string]int{"Deployment": 1}})).To(Succeed())
+		summary, err = getSummary()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(meta.IsStatusConditionTrue(summary.Status.Conditions, helmv1alpha1.ConditionDeployed)).To(BeTrue())
+		Expect(meta.FindStatusCondition(summary.Status.Conditions, helmv1alpha1.ConditionHealthy)).To(And(
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Message", "1 of 2 workloads ready"),
+		))
+		Expect(meta.IsStatusConditionTrue(summary.Status.Conditions, helmv1alpha1.ConditionDrifted)).To(BeTrue())
+
+		// The next revision takes over the summary
+		secretName, rel = newUnicorn("punkunicorn", "default", "punkunicorn", "0.2.0", "1.0", 2, rspb.StatusDeployed)
+		Expect(driver.Create(secretName, rel)).To(Succeed())
+		req.Name = secretName
+		Expect(r.updateSummary(ctx, req, rel, nil, nil)).To(Succeed())
+		summary, err = getSummary()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(summary.OwnerReferences[0].Name).To(Equal(secretName))
+		Expect(summary.Status.ChartVersion).To(Equal("0.2.0"))
+
+		Expect(r.deleteSummary(ctx, release)).To(Succeed())
+		_, err = getSummary()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		// Deleting again is fine
+		Expect(r.deleteSummary(ctx, release)).To(Succeed())
+	})
+	It("converts helm status to condition reasons", func() {
+		Expect(conditionReason(rspb.StatusPendingRollback)).To(Equal("PendingRollback"))
+		Expect(conditionReason(rspb.StatusDeployed)).To(Equal("Deployed"))
+		Expect(conditionReason("")).To(Equal("Unknown"))
+	})
+})
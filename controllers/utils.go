@@ -18,6 +18,9 @@ limitations under the License.
 package controllers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -63,3 +66,27 @@ func getGaugeValue(metric *prometheus.GaugeVec, lvs ...string) (float64, error)
 	}
 	return m.Gauge.GetValue(), nil
 }
+
+// configHash returns a fingerprint of the user supplied values of a release.
+// encoding/json sorts map keys, so the serialization is canonical.
+func configHash(config map[string]interface{}) (string, error) {
+	if config == nil {
+		// Releases installed without values store null instead of {}
+		config = map[string]interface{}{}
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return hashBytes(b), nil
+}
+
+// manifestHash returns a fingerprint of the rendered manifest of a release.
+func manifestHash(manifest string) string {
+	return hashBytes([]byte(manifest))
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func mustConfigHash(config map[string]interface{}) string {
+	hash, err := configHash(config)
+	Expect(err).NotTo(HaveOccurred())
+	return hash
+}
+
+var _ = Describe("Release fingerprints", func() {
+	It("does not distinguish between missing and empty values", func() {
+		Expect(mustConfigHash(nil)).To(Equal(mustConfigHash(map[string]interface{}{})))
+	})
+	It("does not depend on the order of values", func() {
+		a := map[string]interface{}{"image": map[string]interface{}{"tag": "1.0", "name": "foo"}, "replicas": 2}
+		b := map[string]interface{}{"replicas": 2, "image": map[string]interface{}{"name": "foo", "tag": "1.0"}}
+		Expect(mustConfigHash(a)).To(Equal(mustConfigHash(b)))
+	})
+	It("changes when values change", func() {
+		a := map[string]interface{}{"replicas": 2}
+		b := map[string]interface{}{"replicas": 3}
+		Expect(mustConfigHash(a)).NotTo(Equal(mustConfigHash(b)))
+	})
+})
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	rspb "helm.sh/helm/v3/pkg/release"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// newValuePath parses a JSONPath expression like ".image.tag". The surrounding
+// braces kubectl requires are optional.
+func newValuePath(path string) (*jsonpath.JSONPath, error) {
+	if !strings.HasPrefix(path, "{") {
+		path = "{" + path + "}"
+	}
+	jp := jsonpath.New(path).AllowMissingKeys(true)
+	if err := jp.Parse(path); err != nil {
+		return nil, err
+	}
+	return jp, nil
+}
+
+// lookupValue evaluates the JSONPath expression path against values and returns
+// the first result. The boolean return value is false if path did not match.
+func lookupValue(path string, values map[string]interface{}) (interface{}, bool, error) {
+	jp, err := newValuePath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	results, err := jp.FindResults(values)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(results) == 0 || len(results[0]) == 0 {
+		return nil, false, nil
+	}
+	return results[0][0].Interface(), true, nil
+}
+
+// formatValue returns the string representation of a value, using JSON for
+// anything that is not a scalar.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool, float64, int, int64:
+		return fmt.Sprint(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// isScalar returns true if v can be exported as a label value as is
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, bool, float64, int, int64:
+		return true
+	}
+	return false
+}
+
+// releaseValues returns the user supplied values of release or, if merged is
+// true, the values of its chart and subcharts merged with them the way helm
+// does it when rendering.
+func releaseValues(release *rspb.Release, merged bool) (map[string]interface{}, error) {
+	if !merged || release.Chart == nil {
+		return release.Config, nil
+	}
+	return chartutil.CoalesceValues(release.Chart, release.Config)
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chart"
+	rspb "helm.sh/helm/v3/pkg/release"
+)
+
+var _ = Describe("Release values", func() {
+	values := map[string]interface{}{
+		"image":        map[string]interface{}{"tag": "1.2.3"},
+		"replicaCount": float64(3),
+	}
+
+	It("looks up values by JSONPath", func() {
+		v, found, err := lookupValue(".image.tag", values)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(v).To(Equal("1.2.3"))
+
+		v, found, err = lookupValue("{.replicaCount}", values)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(v).To(Equal(float64(3)))
+	})
+	It("does not fail on missing values", func() {
+		_, found, err := lookupValue(".resources.limits.memory", values)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+	})
+	It("merges user supplied values into chart and subchart values", func() {
+		subchart := &chart.Chart{
+			Metadata: &chart.Metadata{Name: "redis"},
+			Values:   map[string]interface{}{"image": map[string]interface{}{"tag": "7.0"}},
+		}
+		c := &chart.Chart{
+			Metadata: &chart.Metadata{Name: "foo", Dependencies: []*chart.Dependency{{Name: "redis"}}},
+			Values: map[string]interface{}{
+				"image":     map[string]interface{}{"repository": "foo", "tag": "latest"},
+				"resources": map[string]interface{}{"limits": map[string]interface{}{"memory": "1Gi"}},
+			},
+		}
+		c.AddDependency(subchart)
+		release := &rspb.Release{Chart: c, Config: map[string]interface{}{
+			"image":     map[string]interface{}{"tag": "1.2.3"},
+			"resources": nil,
+		}}
+
+		merged, err := releaseValues(release, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(merged).To(HaveKeyWithValue("image", map[string]interface{}{"repository": "foo", "tag": "1.2.3"}))
+		Expect(merged).ToNot(HaveKey("resources"))
+		v, found, err := lookupValue(".redis.image.tag", merged)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(v).To(Equal("7.0"))
+
+		values, err := releaseValues(release, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(values).To(Equal(release.Config))
+	})
+	It("exports scalars only", func() {
+		Expect(isScalar("1.2.3")).To(BeTrue())
+		Expect(isScalar(true)).To(BeTrue())
+		Expect(isScalar(values["image"])).To(BeFalse())
+		Expect(isScalar([]interface{}{"a"})).To(BeFalse())
+		Expect(isScalar(nil)).To(BeFalse())
+	})
+})
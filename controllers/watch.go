@@ -0,0 +1,294 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rspb "helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Release transitions
+const (
+	transitionInstalled      = "installed"
+	transitionUpgraded       = "upgraded"
+	transitionFailed         = "failed"
+	transitionRolledBack     = "rolled_back"
+	transitionUninstalled    = "uninstalled"
+	transitionPendingTooLong = "pending_too_long"
+)
+
+const (
+	// Number of past transitions kept to resume streams from
+	transitionBufferSize = 1000
+	// Number of transitions buffered per stream before it is closed
+	streamBufferSize = 100
+	// Interval of keep alive comments sent to idle streams
+	streamKeepAlive = 30 * time.Second
+)
+
+// transitionRevision is the state of a revision as part of a transition
+type transitionRevision struct {
+	Revision     int    `json:"revision"`
+	ChartVersion string `json:"chartVersion"`
+	Status       string `json:"status"`
+}
+
+// transition is a change of the state of a release
+type transition struct {
+	Sequence  uint64    `json:"sequence"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Chart     string    `json:"chart,omitempty"`
+	// From is the revision before the transition (if any)
+	From *transitionRevision `json:"from,omitempty"`
+	// To is the revision after the transition (not set if the release was deleted)
+	To *transitionRevision `json:"to,omitempty"`
+}
+
+// transitionBroker keeps the latest transitions and publishes them to all
+// subscribed streams.
+type transitionBroker struct {
+	mu sync.Mutex
+	// epoch identifies the instance sequence numbers were assigned by, as
+	// they start over after a restart
+	epoch       string
+	sequence    uint64
+	buffer      []transition
+	subscribers map[chan transition]bool
+}
+
+func newTransitionBroker() *transitionBroker {
+	return &transitionBroker{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 10),
+		subscribers: map[chan transition]bool{},
+	}
+}
+
+// publish assigns the next sequence number to t and sends it to all
+// subscribers. Subscribers that can't keep up are closed. The published
+// transition is returned.
+func (b *transitionBroker) publish(t transition) transition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sequence++
+	t.Sequence = b.sequence
+	b.buffer = append(b.buffer, t)
+	if len(b.buffer) > transitionBufferSize {
+		b.buffer = b.buffer[len(b.buffer)-transitionBufferSize:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- t:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return t
+}
+
+// subscribe returns a channel receiving all future transitions and, if since
+// is not nil, the buffered transitions after sequence since of epoch (the
+// current one, if empty). truncated is true if transitions after since are no
+// longer buffered. The channel is closed by unsubscribe or if the subscriber
+// can't keep up.
+func (b *transitionBroker) subscribe(epoch string, since *uint64) (backlog []transition, truncated bool, ch chan transition) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if since != nil {
+		if epoch != "" && epoch != b.epoch {
+			// Sequence numbers of another instance (before a restart)
+			since, truncated = new(uint64), true
+		}
+		for _, t := range b.buffer {
+			if t.Sequence > *since {
+				backlog = append(backlog, t)
+			}
+		}
+		// Sequence numbers from before a restart are unknown
+		truncated = truncated || *since > b.sequence || (*since < b.sequence && b.buffer[0].Sequence > *since+1)
+	}
+	ch = make(chan transition, streamBufferSize)
+	b.subscribers[ch] = true
+	return backlog, truncated, ch
+}
+
+func (b *transitionBroker) unsubscribe(ch chan transition) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// transitionType returns the type of transition a release made by moving to
+// revision info. status is the previous status of the revision (empty if it is
+// a new revision). An empty string is returned for intermediate states.
+func transitionType(status rspb.Status, info revisionInfo, previous *revisionInfo) string {
+	if status == info.Status {
+		return ""
+	}
+	switch info.Status {
+	case rspb.StatusDeployed:
+		if _, isRollback := info.rollbackTo(); isRollback {
+			return transitionRolledBack
+		}
+		if previous == nil {
+			return transitionInstalled
+		}
+		return transitionUpgraded
+	case rspb.StatusFailed:
+		return transitionFailed
+	case rspb.StatusUninstalled:
+		return transitionUninstalled
+	}
+	return ""
+}
+
+func newTransitionRevision(info *revisionInfo) *transitionRevision {
+	if info == nil {
+		return nil
+	}
+	return &transitionRevision{Revision: info.Revision, ChartVersion: info.ChartVersion, Status: info.Status.String()}
+}
+
+// publishTransition publishes a transition of release from revision from to
+// revision to (both may be nil), sends it to the notification sinks and emits
+// an Event if enabled.
+func (r *SecretReconciler) publishTransition(ctx context.Context, kind string, release types.NamespacedName, from, to *revisionInfo) {
+	t := transition{
+		Type:      kind,
+		Time:      time.Now(),
+		Name:      release.Name,
+		Namespace: release.Namespace,
+		From:      newTransitionRevision(from),
+		To:        newTransitionRevision(to),
+	}
+	if to != nil {
+		t.Chart = to.Chart
+	} else if from != nil {
+		t.Chart = from.Chart
+	}
+	t = r.transitions.publish(t)
+	log.FromContext(ctx).V(1).Info("Release transition", "type", kind, "from", t.From, "to", t.To, "sequence", t.Sequence)
+	if r.Notifier != nil {
+		r.Notifier.notify(t)
+	}
+	if r.Events {
+		revision := to
+		if revision == nil {
+			revision = from
+		}
+		eventType, reason, message := r.transitionEvent(kind, release, from, to)
+		r.emitEvent(release.Namespace, releaseSecretName(release.Name, revision.Revision), eventType, reason, message)
+	}
+}
+
+// serveWatch streams release transitions as Server-Sent Events. Event IDs are
+// the epoch of the broker and the sequence number of the transition, joined by
+// a dash. Streams can be resumed by passing the last seen ID (or sequence
+// number) as Last-Event-ID header or "since" parameter.
+func (r *SecretReconciler) serveWatch(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "streaming not supported"})
+		return
+	}
+	var epoch string
+	var since *uint64
+	for _, v := range []string{req.Header.Get("Last-Event-ID"), req.URL.Query().Get("since")} {
+		if v == "" {
+			continue
+		}
+		e, seq, _ := strings.Cut(v, "-")
+		if seq == "" {
+			e, seq = "", v
+		}
+		sequence, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid event ID %q", v)})
+			return
+		}
+		epoch, since = e, &sequence
+	}
+	namespace := req.URL.Query().Get("namespace")
+
+	backlog, truncated, ch := r.transitions.subscribe(epoch, since)
+	defer r.transitions.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if truncated {
+		// Clients need to resynchronize (e.g. by listing all releases)
+		fmt.Fprint(w, "event: truncated\ndata: {}\n\n")
+	}
+	write := func(t transition) error {
+		if namespace != "" && t.Namespace != namespace {
+			return nil
+		}
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %s-%d\ndata: %s\n\n", r.transitions.epoch, t.Sequence, data)
+		return err
+	}
+	for _, t := range backlog {
+		if err := write(t); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case t, ok := <-ch:
+			if !ok {
+				log.Log.Info("Closing slow transition stream", "remote", req.RemoteAddr)
+				return
+			}
+			if err := write(t); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Release transitions", func() {
+	release := types.NamespacedName{Name: "punkunicorn", Namespace: "default"}
+
+	It("detects the type of transitions", func() {
+		previous := &revisionInfo{Revision: 1, Status: rspb.StatusSuperseded}
+		Expect(transitionType("", revisionInfo{Revision: 1, Status: rspb.StatusDeployed}, nil)).To(Equal(transitionInstalled))
+		Expect(transitionType(rspb.StatusPendingUpgrade, revisionInfo{Revision: 2, Status: rspb.StatusDeployed}, previous)).To(Equal(transitionUpgraded))
+		Expect(transitionType(rspb.StatusPendingUpgrade, revisionInfo{Revision: 2, Status: rspb.StatusFailed}, previous)).To(Equal(transitionFailed))
+		Expect(transitionType(rspb.StatusPendingRollback, revisionInfo{Revision: 3, Status: rspb.StatusDeployed, Description: "Rollback to 1"}, previous)).To(Equal(transitionRolledBack))
+		Expect(transitionType(rspb.StatusUninstalling, revisionInfo{Revision: 2, Status: rspb.StatusUninstalled}, previous)).To(Equal(transitionUninstalled))
+		// Intermediate and unchanged states are no transitions
+		Expect(transitionType("", revisionInfo{Revision: 2, Status: rspb.StatusPendingUpgrade}, previous)).To(BeEmpty())
+		Expect(transitionType(rspb.StatusDeployed, revisionInfo{Revision: 2, Status: rspb.StatusSuperseded}, previous)).To(BeEmpty())
+		Expect(transitionType(rspb.StatusDeployed, revisionInfo{Revision: 2, Status: rspb.StatusDeployed}, previous)).To(BeEmpty())
+	})
+	It("resumes from a sequence number", func() {
+		b := newTransitionBroker()
+		for i := 0; i < 3; i++ {
+			b.publish(transition{Type: transitionUpgraded})
+		}
+		since := uint64(1)
+		backlog, truncated, ch := b.subscribe("", &since)
+		defer b.unsubscribe(ch)
+		Expect(truncated).To(BeFalse())
+		Expect(backlog).To(HaveLen(2))
+		Expect(backlog[0].Sequence).To(Equal(uint64(2)))
+
+		b.publish(transition{Type: transitionFailed})
+		Expect(<-ch).To(HaveField("Sequence", uint64(4)))
+	})
+	It("reports transitions that are no longer buffered", func() {
+		b := newTransitionBroker()
+		for i := 0; i < transitionBufferSize+2; i++ {
+			b.publish(transition{Type: transitionUpgraded})
+		}
+		since := uint64(1)
+		backlog, truncated, ch := b.subscribe("", &since)
+		b.unsubscribe(ch)
+		Expect(truncated).To(BeTrue())
+		Expect(backlog).To(HaveLen(transitionBufferSize))
+
+		// Sequence numbers from before a restart
+		since = transitionBufferSize + 10
+		_, truncated, ch = b.subscribe("", &since)
+		b.unsubscribe(ch)
+		Expect(truncated).To(BeTrue())
+
+		// Sequence numbers of another instance
+		since = 5
+		backlog, truncated, ch = b.subscribe("1", &since)
+		b.unsubscribe(ch)
+		Expect(truncated).To(BeTrue())
+		Expect(backlog).To(HaveLen(transitionBufferSize))
+		backlog, truncated, ch = b.subscribe(b.epoch, &since)
+		b.unsubscribe(ch)
+		Expect(truncated).To(BeFalse())
+		Expect(backlog).To(HaveLen(transitionBufferSize - 3))
+
+		backlog, truncated, ch = b.subscribe("", nil)
+		b.unsubscribe(ch)
+		Expect(truncated).To(BeFalse())
+		Expect(backlog).To(BeEmpty())
+	})
+	It("closes subscribers that can't keep up", func() {
+		b := newTransitionBroker()
+		_, _, ch := b.subscribe("", nil)
+		for i := 0; i < streamBufferSize+1; i++ {
+			b.publish(transition{Type: transitionUpgraded})
+		}
+		// The buffered transitions can still be received from the closed channel
+		received := 0
+		for range ch {
+			received++
+		}
+		Expect(received).To(Equal(streamBufferSize))
+		b.unsubscribe(ch)
+	})
+	It("streams transitions as Server-Sent Events", func() {
+		r := &SecretReconciler{transitions: newTransitionBroker()}
+		r.publishTransition(context.Background(), transitionInstalled, release, nil, &revisionInfo{Revision: 1, ChartVersion: "0.1.0", Status: rspb.StatusDeployed})
+		r.publishTransition(context.Background(), transitionInstalled, types.NamespacedName{Name: "other", Namespace: "kube-system"}, nil, &revisionInfo{Revision: 1})
+
+		server := httptest.NewServer(r.APIHandler())
+		defer server.Close()
+		resp, err := http.Get(server.URL + "/api/v1/watch?namespace=default&since=0")
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+		stream := bufio.NewReader(resp.Body)
+		readEvent := func() string {
+			var event strings.Builder
+			for {
+				line, err := stream.ReadString('\n')
+				Expect(err).ToNot(HaveOccurred())
+				if line == "\n" {
+					return event.String()
+				}
+				event.WriteString(line)
+			}
+		}
+		event := readEvent()
+		Expect(event).To(HavePrefix("id: " + r.transitions.epoch + "-1\ndata: "))
+		Expect(event).To(ContainSubstring(`"type":"installed","time":`))
+		Expect(event).To(ContainSubstring(`"to":{"revision":1,"chartVersion":"0.1.0","status":"deployed"}`))
+
+		// The subscription is set up before the response headers are sent
+		r.publishTransition(context.Background(), transitionUpgraded, release, &revisionInfo{Revision: 1}, &revisionInfo{Revision: 2})
+		event = readEvent()
+		Expect(event).To(HavePrefix("id: " + r.transitions.epoch + "-3\ndata: "))
+		Expect(event).To(ContainSubstring(`"from":{"revision":1,`))
+
+		// Resuming from an event ID of another instance
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/watch?namespace=default", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Last-Event-ID", "1-3")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		stream = bufio.NewReader(resp.Body)
+		Expect(readEvent()).To(HavePrefix("event: truncated\n"))
+		Expect(readEvent()).To(HavePrefix("id: " + r.transitions.epoch + "-1\n"))
+	})
+	It("does not report pending revisions if the timeout is 0", func() {
+		c := fake.NewClientBuilder().Build()
+		secretName, rel := newUnicorn("pendingunicorn", "pending", "pendingunicorn", "0.1.0", "1.0", 1, rspb.StatusPendingInstall)
+		Expect(helmStorageDriver.NewSecrets(NewSecretsClient(c, "pending")).Create(secretName, rel)).To(Succeed())
+
+		r := &SecretReconciler{Client: c}
+		Expect(r.Snapshot(context.Background(), "pending")).To(Succeed())
+		Expect(r.transitions.buffer).To(BeEmpty())
+
+		r = &SecretReconciler{Client: c, PendingTimeout: time.Minute}
+		Expect(r.Snapshot(context.Background(), "pending")).To(Succeed())
+		Expect(r.transitions.buffer).To(ConsistOf(HaveField("Type", transitionPendingTooLong)))
+	})
+})
@@ -0,0 +1,271 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Reasons for deployments outside of the allowed windows
+const (
+	windowReasonFreeze        = "freeze"
+	windowReasonOutsideWindow = "outside_window"
+)
+
+// Layouts accepted for the start and end of freezes
+var freezeTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// DeploymentWindowsConfig is the format of the deployment windows configuration file
+type DeploymentWindowsConfig struct {
+	// Timezone is the default timezone (like "Europe/Berlin") of all windows and
+	// freezes. Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+	// Windows are the times deployments are allowed. Deployments to namespaces
+	// without matching windows are always allowed (unless frozen).
+	Windows []DeploymentWindowConfig `json:"windows,omitempty"`
+	// Freezes are periods no deployments are allowed.
+	Freezes []DeploymentFreezeConfig `json:"freezes,omitempty"`
+}
+
+// DeploymentWindowConfig defines a recurring time deployments are allowed
+type DeploymentWindowConfig struct {
+	// Namespaces is a list of namespace patterns (like "prod-*") the window
+	// applies to. The window applies to all namespaces if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Days is a list of weekdays (like "Mon") the window is open. Defaults to
+	// every day.
+	Days []string `json:"days,omitempty"`
+	// Start and End are the time of day (like "09:00") the window opens and
+	// closes. Windows with End before Start close on the next day. Defaults
+	// to the whole day.
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// DeploymentFreezeConfig defines a period no deployments are allowed
+type DeploymentFreezeConfig struct {
+	// Namespaces is a list of namespace patterns (like "prod-*") the freeze
+	// applies to. The freeze applies to all namespaces if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Start and End of the freeze (like "2022-12-19" or "2022-12-19 18:00")
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type deploymentWindow struct {
+	namespaces []string
+	days       map[time.Weekday]bool
+	// start and end are offsets from midnight
+	start, end time.Duration
+	location   *time.Location
+}
+
+type deploymentFreeze struct {
+	namespaces []string
+	start, end time.Time
+	reason     string
+}
+
+// DeploymentWindows are the times deployments are allowed
+type DeploymentWindows struct {
+	windows []deploymentWindow
+	freezes []deploymentFreeze
+}
+
+// windowViolation describes why a deployment was outside of the allowed windows
+type windowViolation struct {
+	Reason string
+	Detail string
+}
+
+// NewDeploymentWindows reads the deployment windows configuration file at path.
+func NewDeploymentWindows(path string) (*DeploymentWindows, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config DeploymentWindowsConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse deployment windows config %q: %w", path, err)
+	}
+
+	defaultLocation, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	location := func(tz string) (*time.Location, error) {
+		if tz == "" {
+			return defaultLocation, nil
+		}
+		return time.LoadLocation(tz)
+	}
+
+	w := &DeploymentWindows{}
+	for i, wc := range config.Windows {
+		window := deploymentWindow{namespaces: wc.Namespaces, end: 24 * time.Hour}
+		if err := validatePatterns(wc.Namespaces); err != nil {
+			return nil, fmt.Errorf("invalid window %d: %w", i, err)
+		}
+		if window.location, err = location(wc.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid window %d: %w", i, err)
+		}
+		if len(wc.Days) > 0 {
+			window.days = map[time.Weekday]bool{}
+			for _, d := range wc.Days {
+				day, ok := parseWeekday(d)
+				if !ok {
+					return nil, fmt.Errorf("invalid window %d: unknown day %q", i, d)
+				}
+				window.days[day] = true
+			}
+		}
+		if wc.Start != "" {
+			if window.start, err = parseTimeOfDay(wc.Start); err != nil {
+				return nil, fmt.Errorf("invalid window %d: %w", i, err)
+			}
+		}
+		if wc.End != "" {
+			if window.end, err = parseTimeOfDay(wc.End); err != nil {
+				return nil, fmt.Errorf("invalid window %d: %w", i, err)
+			}
+		}
+		w.windows = append(w.windows, window)
+	}
+	for i, fc := range config.Freezes {
+		freeze := deploymentFreeze{namespaces: fc.Namespaces, reason: fc.Reason}
+		if err := validatePatterns(fc.Namespaces); err != nil {
+			return nil, fmt.Errorf("invalid freeze %d: %w", i, err)
+		}
+		loc, err := location(fc.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid freeze %d: %w", i, err)
+		}
+		if freeze.start, err = parseFreezeTime(fc.Start, loc); err != nil {
+			return nil, fmt.Errorf("invalid freeze %d: %w", i, err)
+		}
+		if freeze.end, err = parseFreezeTime(fc.End, loc); err != nil {
+			return nil, fmt.Errorf("invalid freeze %d: %w", i, err)
+		}
+		if !freeze.end.After(freeze.start) {
+			return nil, fmt.Errorf("invalid freeze %d: end is not after start", i)
+		}
+		w.freezes = append(w.freezes, freeze)
+	}
+	return w, nil
+}
+
+// Check returns why a deployment to namespace at t was not allowed. The
+// boolean return value is false if the deployment was allowed.
+func (w *DeploymentWindows) Check(namespace string, t time.Time) (windowViolation, bool) {
+	for _, freeze := range w.freezes {
+		if matchPatterns(freeze.namespaces, namespace) && !t.Before(freeze.start) && t.Before(freeze.end) {
+			return windowViolation{Reason: windowReasonFreeze, Detail: freeze.reason}, true
+		}
+	}
+	matched := false
+	for _, window := range w.windows {
+		if !matchPatterns(window.namespaces, namespace) {
+			continue
+		}
+		matched = true
+		if window.contains(t) {
+			return windowViolation{}, false
+		}
+	}
+	if matched {
+		return windowViolation{Reason: windowReasonOutsideWindow}, true
+	}
+	return windowViolation{}, false
+}
+
+// contains returns true if the window is open at t
+func (w deploymentWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	// Wall clock time of day, as on days of DST changes the time elapsed since
+	// midnight differs from it by an hour.
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	openOn := func(day time.Weekday) bool { return w.days == nil || w.days[day] }
+	if w.start <= w.end {
+		return openOn(t.Weekday()) && offset >= w.start && offset < w.end
+	}
+	// The window spans midnight, so it might have opened the day before
+	yesterday := (t.Weekday() + 6) % 7
+	return (openOn(t.Weekday()) && offset >= w.start) || (openOn(yesterday) && offset < w.end)
+}
+
+// matchPatterns returns true if s matches one of patterns or if there are no
+// patterns at all
+func matchPatterns(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) || strings.EqualFold(s, d.String()[:3]) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// parseTimeOfDay parses a time of day (like "09:00") into the offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseFreezeTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range freezeTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
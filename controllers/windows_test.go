@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deployment windows", func() {
+	var windows *DeploymentWindows
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+
+	BeforeEach(func() {
+		config := filepath.Join(GinkgoT().TempDir(), "windows.yaml")
+		Expect(os.WriteFile(config, []byte(`
+timezone: Europe/Berlin
+windows:
+  - namespaces: ["prod-*"]
+    days: [Mon, Tue, Wed, Thu]
+    start: "09:00"
+    end: "17:00"
+  - namespaces: ["daily"]
+    start: "09:00"
+    end: "17:00"
+  - namespaces: ["batch"]
+    start: "22:00"
+    end: "06:00"
+    timezone: UTC
+freezes:
+  - start: "2022-12-19"
+    end: "2023-01-02"
+    reason: End of year
+`), 0o644)).To(Succeed())
+		var err error
+		windows, err = NewDeploymentWindows(config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("allows deployments within a window", func() {
+		// Tuesday
+		_, violated := windows.Check("prod-eqiad", time.Date(2022, 11, 15, 10, 0, 0, 0, berlin))
+		Expect(violated).To(BeFalse())
+	})
+	It("reports deployments outside of all windows", func() {
+		// Friday
+		violation, violated := windows.Check("prod-eqiad", time.Date(2022, 11, 18, 10, 0, 0, 0, berlin))
+		Expect(violated).To(BeTrue())
+		Expect(violation.Reason).To(Equal(windowReasonOutsideWindow))
+		// Tuesday evening, in UTC
+		_, violated = windows.Check("prod-eqiad", time.Date(2022, 11, 15, 16, 30, 0, 0, time.UTC))
+		Expect(violated).To(BeTrue())
+	})
+	It("supports windows spanning midnight", func() {
+		_, violated := windows.Check("batch", time.Date(2022, 11, 15, 23, 0, 0, 0, time.UTC))
+		Expect(violated).To(BeFalse())
+		_, violated = windows.Check("batch", time.Date(2022, 11, 16, 5, 0, 0, 0, time.UTC))
+		Expect(violated).To(BeFalse())
+		_, violated = windows.Check("batch", time.Date(2022, 11, 16, 12, 0, 0, 0, time.UTC))
+		Expect(violated).To(BeTrue())
+	})
+	It("uses the wall clock time on days of DST changes", func() {
+		// Clocks were set forward an hour on 2023-03-26 in Europe/Berlin
+		_, violated := windows.Check("daily", time.Date(2023, 3, 26, 9, 30, 0, 0, berlin))
+		Expect(violated).To(BeFalse())
+		_, violated = windows.Check("daily", time.Date(2023, 3, 26, 17, 30, 0, 0, berlin))
+		Expect(violated).To(BeTrue())
+		// and back on 2022-10-30
+		_, violated = windows.Check("daily", time.Date(2022, 10, 30, 8, 30, 0, 0, berlin))
+		Expect(violated).To(BeTrue())
+		_, violated = windows.Check("daily", time.Date(2022, 10, 30, 16, 30, 0, 0, berlin))
+		Expect(violated).To(BeFalse())
+	})
+	It("allows deployments to namespaces without windows", func() {
+		_, violated := windows.Check("staging", time.Date(2022, 11, 19, 3, 0, 0, 0, berlin))
+		Expect(violated).To(BeFalse())
+	})
+	It("reports deployments during freezes", func() {
+		violation, violated := windows.Check("staging", time.Date(2022, 12, 20, 10, 0, 0, 0, berlin))
+		Expect(violated).To(BeTrue())
+		Expect(violation).To(Equal(windowViolation{Reason: windowReasonFreeze, Detail: "End of year"}))
+		_, violated = windows.Check("staging", time.Date(2023, 1, 2, 0, 0, 0, 0, berlin))
+		Expect(violated).To(BeFalse())
+	})
+	It("rejects invalid configuration", func() {
+		config := filepath.Join(GinkgoT().TempDir(), "windows.yaml")
+		Expect(os.WriteFile(config, []byte(`
+windows:
+  - days: [Caturday]
+`), 0o644)).To(Succeed())
+		_, err := NewDeploymentWindows(config)
+		Expect(err).To(MatchError(ContainSubstring("unknown day")))
+	})
+})
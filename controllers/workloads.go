@@ -0,0 +1,133 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Annotations helm sets on all objects of a release
+const (
+	annotationReleaseName      = "meta.helm.sh/release-name"
+	annotationReleaseNamespace = "meta.helm.sh/release-namespace"
+)
+
+// workloadKinds are the kinds of objects taken into account for release health
+var workloadKinds = map[string]func() client.Object{
+	"Deployment":  func() client.Object { return &appsv1.Deployment{} },
+	"StatefulSet": func() client.Object { return &appsv1.StatefulSet{} },
+	"DaemonSet":   func() client.Object { return &appsv1.DaemonSet{} },
+	"Job":         func() client.Object { return &batchv1.Job{} },
+}
+
+// workloadsStatus is the health of the workloads of a release
+type workloadsStatus struct {
+	Ready int
+	Total int
+}
+
+// getWorkloadsStatus reads the workloads in the manifest objects objs from
+// reader and returns how many of them are ready. Workloads that do not exist are
+// not ready, except for Jobs which are skipped as they are usually deleted after
+// completion (by ttlSecondsAfterFinished or hook deletion policies).
+func getWorkloadsStatus(ctx context.Context, reader client.Reader, namespace string, objs []*unstructured.Unstructured) (workloadsStatus, error) {
+	var status workloadsStatus
+	for _, obj := range objs {
+		newObj, ok := workloadKinds[obj.GetKind()]
+		if !ok {
+			continue
+		}
+		key := types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}
+		if key.Namespace == "" {
+			key.Namespace = namespace
+		}
+		workload := newObj()
+		if err := reader.Get(ctx, key, workload); err != nil {
+			if apierrors.IsNotFound(err) {
+				if _, isJob := workload.(*batchv1.Job); !isJob {
+					status.Total++
+				}
+				continue
+			}
+			return status, err
+		}
+		status.Total++
+		if isWorkloadReady(workload) {
+			status.Ready++
+		}
+	}
+	return status, nil
+}
+
+// isWorkloadReady returns true if all replicas of a workload are updated to the
+// latest spec and ready (or, for Jobs, if the Job has completed). StatefulSets
+// only need the replicas their update strategy updates to be updated.
+func isWorkloadReady(obj client.Object) bool {
+	switch w := obj.(type) {
+	case *appsv1.Deployment:
+		replicas := int32(1)
+		if w.Spec.Replicas != nil {
+			replicas = *w.Spec.Replicas
+		}
+		for _, c := range w.Status.Conditions {
+			if c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+				return false
+			}
+		}
+		return w.Status.ObservedGeneration >= w.Generation &&
+			w.Status.UpdatedReplicas == replicas &&
+			w.Status.Replicas == replicas &&
+			w.Status.AvailableReplicas == replicas
+	case *appsv1.StatefulSet:
+		replicas := int32(1)
+		if w.Spec.Replicas != nil {
+			replicas = *w.Spec.Replicas
+		}
+		if w.Status.ObservedGeneration < w.Generation || w.Status.ReadyReplicas != replicas {
+			return false
+		}
+		if w.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+			// Pods are only updated when they are deleted
+			return true
+		}
+		if ru := w.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil && *ru.Partition > 0 {
+			// Only pods with an ordinal of at least partition are updated
+			return w.Status.UpdatedReplicas >= replicas-*ru.Partition
+		}
+		return w.Status.UpdatedReplicas == replicas &&
+			w.Status.CurrentRevision == w.Status.UpdateRevision
+	case *appsv1.DaemonSet:
+		return w.Status.ObservedGeneration >= w.Generation &&
+			w.Status.UpdatedNumberScheduled == w.Status.DesiredNumberScheduled &&
+			w.Status.NumberReady == w.Status.DesiredNumberScheduled
+	case *batchv1.Job:
+		for _, c := range w.Status.Conditions {
+			if c.Type == batchv1.JobComplete && c.Status == corev1.ConditionTrue {
+				return true
+			}
+		}
+	}
+	return false
+}
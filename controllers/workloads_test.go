@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rspb "helm.sh/helm/v3/pkg/release"
+	helmStorageDriver "helm.sh/helm/v3/pkg/storage/driver"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("Workload readiness", func() {
+	replicas := int32(3)
+	deployment := func(updated, available int32) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Generation: 2},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status: appsv1.DeploymentStatus{
+				ObservedGeneration: 2,
+				Replicas:           3,
+				UpdatedReplicas:    updated,
+				AvailableReplicas:  available,
+			},
+		}
+	}
+
+	It("considers Deployments with all replicas updated and available ready", func() {
+		Expect(isWorkloadReady(deployment(3, 3))).To(BeTrue())
+		Expect(isWorkloadReady(deployment(2, 3))).To(BeFalse())
+		Expect(isWorkloadReady(deployment(3, 1))).To(BeFalse())
+	})
+	It("considers completed Jobs ready", func() {
+		job := &batchv1.Job{}
+		Expect(isWorkloadReady(job)).To(BeFalse())
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+		Expect(isWorkloadReady(job)).To(BeTrue())
+	})
+	It("considers StatefulSets ready according to their update strategy", func() {
+		sts := &appsv1.StatefulSet{
+			Spec: appsv1.StatefulSetSpec{Replicas: &replicas},
+			Status: appsv1.StatefulSetStatus{
+				Replicas:        3,
+				ReadyReplicas:   3,
+				UpdatedReplicas: 1,
+				CurrentRevision: "web-1",
+				UpdateRevision:  "web-2",
+			},
+		}
+		Expect(isWorkloadReady(sts)).To(BeFalse())
+
+		partition := int32(2)
+		sts.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{
+			Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+			RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+		}
+		Expect(isWorkloadReady(sts)).To(BeTrue())
+
+		sts.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}
+		sts.Status.UpdatedReplicas = 0
+		Expect(isWorkloadReady(sts)).To(BeTrue())
+		sts.Status.ReadyReplicas = 2
+		Expect(isWorkloadReady(sts)).To(BeFalse())
+	})
+	It("skips deleted Jobs", func() {
+		d := deployment(3, 3)
+		d.Name, d.Namespace, d.ResourceVersion = "web", "default", ""
+		c := fake.NewClientBuilder().WithObjects(d).Build()
+		objs, err := parseManifest("---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n" +
+			"---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: missing\n" +
+			"---\napiVersion: batch/v1\nkind: Job\nmetadata:\n  name: migrate\n")
+		Expect(err).ToNot(HaveOccurred())
+		status, err := getWorkloadsStatus(context.Background(), c, "default", objs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(status).To(Equal(workloadsStatus{Ready: 1, Total: 2}))
+	})
+	It("enqueues the latest secret of the release of a workload", func() {
+		c := fake.NewClientBuilder().Build()
+		driver := helmStorageDriver.NewSecrets(NewSecretsClient(c, "default"))
+		for _, revision := range []int{2, 9, 10} {
+			secretName, rel := newUnicorn("workunicorn", "default", "workunicorn", "0.1.0", "1.0", revision, rspb.StatusSuperseded)
+			Expect(driver.Create(secretName, rel)).To(Succeed())
+		}
+		r := &SecretReconciler{Client: c}
+		d := deployment(3, 3)
+		d.Annotations = map[string]string{annotationReleaseName: "workunicorn", annotationReleaseNamespace: "default"}
+		Expect(r.releaseSecretsForObject(d)).To(ConsistOf(
+			reconcile.Request{NamespacedName: types.NamespacedName{Name: "sh.helm.release.v1.workunicorn.v10", Namespace: "default"}},
+		))
+	})
+})
@@ -0,0 +1,115 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"sigs.k8s.io/yaml"
+
+	"gerrit.wikimedia.org/r/operations/software/helm-state-metrics/controllers"
+)
+
+// runDecode implements the decode subcommand, printing a single release read
+// from a Secret, ConfigMap or the value of their release key.
+func runDecode(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s decode [flags] [FILE]\n\n"+
+			"Decode a helm release from a Secret or ConfigMap (in YAML or JSON) or from the value of their release key, "+
+			"read from FILE or stdin.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	output := fs.String("output", "yaml", "Output format, one of yaml or json. The manifest is always printed as is.")
+	values := fs.Bool("values", false, "Print the user supplied values only.")
+	manifest := fs.Bool("manifest", false, "Print the manifest only.")
+	hooks := fs.Bool("hooks", false, "Print the hooks only.")
+	chartMetadata := fs.Bool("chart-metadata", false, "Print the metadata of the chart only.")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	if *output != "yaml" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid output format %q\n", *output)
+		return 2
+	}
+	selected := 0
+	for _, s := range []bool{*values, *manifest, *hooks, *chartMetadata} {
+		if s {
+			selected++
+		}
+	}
+	if selected > 1 {
+		fmt.Fprintln(os.Stderr, "Only one of --values, --manifest, --hooks and --chart-metadata may be given")
+		return 2
+	}
+
+	in := os.Stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read release: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read release: %v\n", err)
+		return 1
+	}
+	release, err := controllers.DecodeRelease(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to decode release: %v\n", err)
+		return 1
+	}
+
+	var v interface{} = release
+	switch {
+	case *manifest:
+		fmt.Print(release.Manifest)
+		return 0
+	case *values:
+		v = release.Config
+	case *hooks:
+		v = release.Hooks
+	case *chartMetadata:
+		if release.Chart == nil {
+			fmt.Fprintln(os.Stderr, "Release has no chart")
+			return 1
+		}
+		v = release.Chart.Metadata
+	}
+	var out []byte
+	if *output == "json" {
+		out, err = json.MarshalIndent(v, "", "  ")
+		out = append(out, '\n')
+	} else {
+		out, err = yaml.Marshal(v)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode release: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"gerrit.wikimedia.org/r/operations/software/helm-state-metrics/controllers"
+)
+
+// runDiff implements the diff subcommand, printing the diff between two
+// revisions of a release.
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [flags] RELEASE\n\n"+
+			"Print a unified diff of the chart metadata, values and manifest of two revisions of a release.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	namespace := fs.String("namespace", "default", "Namespace of the release.")
+	from := fs.Int("from", 0, "Revision to diff from. Defaults to the latest revision before --to.")
+	to := fs.Int("to", 0, "Revision to diff to. Defaults to the latest revision.")
+	apiURL := fs.String("api-url", "",
+		"URL of a helm-state-metrics instance running with --enable-api (like http://localhost:9104). "+
+			"The release secrets are read from the cluster if empty.")
+	fromFiles := addFromFilesFlag(fs)
+	addKubeconfigFlag(fs)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	release := fs.Arg(0)
+
+	var diff string
+	var err error
+	if *apiURL != "" && *fromFiles != "" {
+		fmt.Fprintln(os.Stderr, "Only one of --api-url and --from-files may be given")
+		return 2
+	}
+	if *apiURL != "" {
+		diff, err = fetchDiff(*apiURL, *namespace, release, *from, *to)
+	} else {
+		var c client.Client
+		if c, err = newClient(*fromFiles); err == nil {
+			diff, err = controllers.DiffRevisions(context.Background(), c, *namespace, release, *from, *to)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to diff revisions of %s/%s: %v\n", *namespace, release, err)
+		return 1
+	}
+	fmt.Print(diff)
+	return 0
+}
+
+// fetchDiff reads the diff between two revisions of a release from the API of
+// a running instance.
+func fetchDiff(apiURL, namespace, release string, from, to int) (string, error) {
+	query := url.Values{}
+	if from > 0 {
+		query.Set("from", fmt.Sprint(from))
+	}
+	if to > 0 {
+		query.Set("to", fmt.Sprint(to))
+	}
+	u := fmt.Sprintf("%s%snamespaces/%s/releases/%s/diff", strings.TrimSuffix(apiURL, "/"), controllers.APIPrefix,
+		url.PathEscape(namespace), url.PathEscape(release))
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// addKubeconfigFlag adds the --kubeconfig flag controller-runtime registers on
+// the global flag set to the flag set of a subcommand.
+func addKubeconfigFlag(fs *flag.FlagSet) {
+	if f := flag.CommandLine.Lookup("kubeconfig"); f != nil {
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+// addFromFilesFlag adds the --from-files flag to the flag set of a subcommand
+func addFromFilesFlag(fs *flag.FlagSet) *string {
+	return fs.String("from-files", "",
+		"Comma-separated list of files or directories (- for stdin) of Secret objects in YAML or JSON "+
+			"(like from \"kubectl get secrets -o yaml\") to read releases from instead of the cluster.")
+}
+
+// newClient returns an uncached client for subcommands or, if fromFiles is
+// not empty, an offline client serving the objects read from these files.
+func newClient(fromFiles string) (client.Client, error) {
+	if fromFiles != "" {
+		return controllers.NewOfflineClient(scheme, splitList(fromFiles))
+	}
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	return client.New(config, client.Options{Scheme: scheme})
+}
@@ -18,7 +18,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -29,9 +32,11 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	helmv1alpha1 "gerrit.wikimedia.org/r/operations/software/helm-state-metrics/api/v1alpha1"
 	"gerrit.wikimedia.org/r/operations/software/helm-state-metrics/controllers"
 	//+kubebuilder:scaffold:imports
 )
@@ -43,15 +48,66 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(helmv1alpha1.AddToScheme(scheme))
 
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "decode":
+			os.Exit(runDecode(os.Args[2:]))
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		case "offline":
+			os.Exit(runOffline(os.Args[2:]))
+		case "snapshot":
+			os.Exit(runSnapshot(os.Args[2:]))
+		case "verify-audit-log":
+			os.Exit(runVerifyAuditLog(os.Args[2:]))
+		}
+	}
+
 	var metricsAddr string
 	var probeAddr string
+	var liveObjectsInterval time.Duration
+	var enableAPI bool
+	var pendingTimeout time.Duration
+	var notificationsConfig string
+	var releaseSummaries bool
+	var events bool
+	var eventsObject string
+	var auditLogPath string
+	var auditLogMaxSize int64
+	var auditLogMaxBackups int
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":9104", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	var metricsOpts metricsOptions
+	metricsOpts.bindFlags(flag.CommandLine)
+	flag.DurationVar(&liveObjectsInterval, "live-objects-interval", 5*time.Minute,
+		"How often to compare release manifests with the live objects (see --drift-detection and --ownership-conflicts).")
+	flag.BoolVar(&enableAPI, "enable-api", false,
+		"Serve a read-only JSON API of releases and their history at /api/v1/ on the metrics bind address.")
+	flag.DurationVar(&pendingTimeout, "pending-timeout", 15*time.Minute,
+		"How long a release may be pending before a pending_too_long transition is published on /api/v1/watch (0 disables).")
+	flag.StringVar(&notificationsConfig, "notifications-config", "",
+		"Path to a configuration file of notification sinks (like webhooks) release transitions are sent to.")
+	flag.BoolVar(&releaseSummaries, "release-summaries", false,
+		"Maintain a HelmReleaseSummary object mirroring the state of each release. Requires the HelmReleaseSummary CRD.")
+	flag.BoolVar(&events, "events", false,
+		"Emit Kubernetes Events for release transitions (Normal for installs, upgrades and rollbacks, Warning for failed "+
+			"and pending_too_long releases) and for release secrets that can't be decoded.")
+	flag.StringVar(&eventsObject, "events-object", "",
+		"Object (like configmap/helm-releases) in the namespace of a release to emit Events for instead of the latest "+
+			"release secret.")
+	flag.StringVar(&auditLogPath, "audit-log", "",
+		"Path to a file (or - for stdout) to write a JSON-lines audit log of every observed change of all release revisions to. "+
+			"When writing to stdout, all revisions are recorded again after a restart.")
+	flag.Int64Var(&auditLogMaxSize, "audit-log-max-size", 100,
+		"Size in megabytes after which the audit log file is rotated (0 disables rotation).")
+	flag.IntVar(&auditLogMaxBackups, "audit-log-max-backups", 5,
+		"Number of rotated audit log files to keep.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -59,6 +115,10 @@ func main() {
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if err := metricsOpts.validate(); err != nil {
+		setupLog.Error(err, "invalid flags")
+		os.Exit(2)
+	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
@@ -70,13 +130,56 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.SecretReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	var notifier *controllers.Notifier
+	if notificationsConfig != "" {
+		if notifier, err = controllers.NewNotifier(notificationsConfig); err != nil {
+			setupLog.Error(err, "unable to load notifications config")
+			os.Exit(1)
+		}
+		if err := mgr.Add(notifier); err != nil {
+			setupLog.Error(err, "unable to set up notifier")
+			os.Exit(1)
+		}
+	}
+
+	var auditLog *controllers.AuditLog
+	if auditLogPath != "" {
+		if auditLog, err = controllers.NewAuditLog(auditLogPath, auditLogMaxSize*1024*1024, auditLogMaxBackups); err != nil {
+			setupLog.Error(err, "unable to open audit log")
+			os.Exit(1)
+		}
+	}
+
+	secretReconciler, err := metricsOpts.secretReconciler(mgr.GetClient())
+	if err != nil {
+		setupLog.Error(err, "unable to configure controller", "controller", "Secret")
+		os.Exit(1)
+	}
+	secretReconciler.Scheme = mgr.GetScheme()
+	secretReconciler.PendingTimeout = pendingTimeout
+	secretReconciler.ReleaseSummaries = releaseSummaries
+	secretReconciler.Events = events
+	secretReconciler.EventsObject = eventsObject
+	secretReconciler.AuditLog = auditLog
+	secretReconciler.Notifier = notifier
+	secretReconciler.LiveObjectsInterval = liveObjectsInterval
+	if err = secretReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Secret")
 		os.Exit(1)
 	}
+	if enableAPI {
+		if err := mgr.AddMetricsExtraHandler(controllers.APIPrefix, secretReconciler.APIHandler()); err != nil {
+			setupLog.Error(err, "unable to set up API")
+			os.Exit(1)
+		}
+	}
+	if namespaceReconciler := metricsOpts.namespaceReconciler(mgr.GetClient()); namespaceReconciler != nil {
+		namespaceReconciler.Scheme = mgr.GetScheme()
+		if err = namespaceReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Namespace")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -94,3 +197,151 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma-separated command line argument into its non-empty elements
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// stringsFlag is a command line flag that may be given multiple times, for
+// values that may contain commas.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// metricsOptions are the command line options that shape the metrics of
+// releases, shared by the controller and the snapshot subcommand.
+type metricsOptions struct {
+	namespaceLabelsAllowlist string
+	namespaceLabelsOnInfo    string
+	releaseLabelsAllowlist   string
+	valuePaths               stringsFlag
+	valuePathsMerged         bool
+	scanSecrets              bool
+	policyChecks             bool
+	policyConfig             string
+	validateSchema           bool
+	driftDetection           bool
+	driftIgnorePaths         string
+	workloadHealth           bool
+	ownershipConflicts       bool
+	deploymentWindowsConfig  string
+}
+
+// bindFlags adds the options to fs
+func (o *metricsOptions) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.namespaceLabelsAllowlist, "namespace-labels-allowlist", "",
+		"Comma-separated list of namespace label keys to export as helm_release_namespace_labels. "+
+			"Namespaces are not watched if empty.")
+	fs.StringVar(&o.namespaceLabelsOnInfo, "namespace-labels-on-info", "",
+		"Comma-separated list of namespace label keys to add as labels to helm_release_info.")
+	fs.StringVar(&o.releaseLabelsAllowlist, "release-labels-allowlist", "",
+		"Comma-separated list of helm release label keys (see \"helm install --labels\") to export as helm_release_labels. "+
+			"The storage driver labels name, owner, status and version are always excluded.")
+	fs.Var(&o.valuePaths, "values-jsonpath",
+		"JSONPath expression (like .image.tag) evaluated against the user supplied values of each release, may be "+
+			"given multiple times. Numbers are exported as helm_release_value, other scalars as helm_release_value_info.")
+	fs.BoolVar(&o.valuePathsMerged, "values-jsonpath-merged", false,
+		"Evaluate --values-jsonpath against the chart default values merged with the user supplied values.")
+	fs.BoolVar(&o.scanSecrets, "scan-values-for-secrets", false,
+		"Scan user supplied and chart default values for plaintext credentials and export their paths as "+
+			"helm_release_suspected_secret_values.")
+	fs.BoolVar(&o.policyChecks, "policy-checks", false,
+		"Check the manifest of each release against the built-in policy rules and export helm_release_policy_violations.")
+	fs.StringVar(&o.policyConfig, "policy-config", "",
+		"Path to a policy configuration file to disable or modify built-in rules and define additional ones. "+
+			"Implies --policy-checks.")
+	fs.BoolVar(&o.validateSchema, "validate-values-schema", false,
+		"Validate the values of each release against the values.schema.json of its chart and export "+
+			"helm_release_values_schema_valid.")
+	fs.BoolVar(&o.driftDetection, "drift-detection", false,
+		"Compare the objects in the manifest of deployed releases with the live objects and export "+
+			"helm_release_drifted_resources and helm_release_missing_resources. Requires read access to all objects.")
+	fs.StringVar(&o.driftIgnorePaths, "drift-ignore-paths", "",
+		"Comma-separated list of field paths (like .spec.replicas or Deployment:.spec.replicas) to ignore "+
+			"during drift detection. The replicas of objects targeted by a HorizontalPodAutoscaler are always ignored.")
+	fs.BoolVar(&o.workloadHealth, "workload-health", false,
+		"Watch the Deployments, StatefulSets, DaemonSets and Jobs of each release and export "+
+			"helm_release_workloads_ready and helm_release_workloads_total.")
+	fs.BoolVar(&o.ownershipConflicts, "ownership-conflicts", false,
+		"Detect objects declared by multiple releases and live objects annotated as owned by a different release "+
+			"and export helm_release_ownership_conflicts. Requires read access to all objects.")
+	fs.StringVar(&o.deploymentWindowsConfig, "deployment-windows-config", "",
+		"Path to a configuration file of allowed deployment windows and freezes. Revisions deployed outside of them "+
+			"are counted in helm_release_out_of_window_deployments_total and reported as Warning Events.")
+}
+
+// validate returns an error if the options are inconsistent
+func (o *metricsOptions) validate() error {
+	for name, keys := range map[string]string{
+		"namespace-labels-allowlist": o.namespaceLabelsAllowlist,
+		"namespace-labels-on-info":   o.namespaceLabelsOnInfo,
+		"release-labels-allowlist":   o.releaseLabelsAllowlist,
+	} {
+		if err := controllers.ValidateLabelKeys(splitList(keys)); err != nil {
+			return fmt.Errorf("invalid --%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// needsLiveObjects returns true if any of the enabled features reads the live
+// objects of releases.
+func (o *metricsOptions) needsLiveObjects() bool {
+	return o.driftDetection || o.workloadHealth || o.ownershipConflicts
+}
+
+// secretReconciler returns a SecretReconciler configured by the options
+func (o *metricsOptions) secretReconciler(c client.Client) (*controllers.SecretReconciler, error) {
+	var err error
+	var policy *controllers.Policy
+	if o.policyChecks || o.policyConfig != "" {
+		if policy, err = controllers.NewPolicy(o.policyConfig); err != nil {
+			return nil, fmt.Errorf("unable to load policy: %w", err)
+		}
+	}
+	var deploymentWindows *controllers.DeploymentWindows
+	if o.deploymentWindowsConfig != "" {
+		if deploymentWindows, err = controllers.NewDeploymentWindows(o.deploymentWindowsConfig); err != nil {
+			return nil, fmt.Errorf("unable to load deployment windows: %w", err)
+		}
+	}
+	return &controllers.SecretReconciler{
+		Client:                 c,
+		InfoNamespaceLabels:    splitList(o.namespaceLabelsOnInfo),
+		ReleaseLabelsAllowlist: splitList(o.releaseLabelsAllowlist),
+		ValuePaths:             o.valuePaths,
+		ValuePathsMerged:       o.valuePathsMerged,
+		ScanSecrets:            o.scanSecrets,
+		Policy:                 policy,
+		ValidateSchema:         o.validateSchema,
+		DriftDetection:         o.driftDetection,
+		DriftIgnorePaths:       splitList(o.driftIgnorePaths),
+		WorkloadHealth:         o.workloadHealth,
+		OwnershipConflicts:     o.ownershipConflicts,
+		DeploymentWindows:      deploymentWindows,
+	}, nil
+}
+
+// namespaceReconciler returns a NamespaceReconciler configured by the options
+// or nil if namespace labels are not exported.
+func (o *metricsOptions) namespaceReconciler(c client.Client) *controllers.NamespaceReconciler {
+	allowlist := splitList(o.namespaceLabelsAllowlist)
+	if len(allowlist) == 0 {
+		return nil
+	}
+	return &controllers.NamespaceReconciler{Client: c, LabelsAllowlist: allowlist}
+}
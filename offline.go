@@ -0,0 +1,98 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"gerrit.wikimedia.org/r/operations/software/helm-state-metrics/controllers"
+)
+
+// runOffline implements the offline subcommand, serving the metrics and the
+// JSON API of releases read from files.
+func runOffline(args []string) int {
+	fs := flag.NewFlagSet("offline", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s offline [flags] PATH...\n\n"+
+			"Read helm release secrets from YAML or JSON files and directories (like from \"kubectl get secrets -o yaml\", "+
+			"- for stdin) and serve their metrics at /metrics and the JSON API at %s without a cluster.\n\n",
+			os.Args[0], controllers.APIPrefix)
+		fs.PrintDefaults()
+	}
+	bindAddress := fs.String("bind-address", ":9104", "The address the metrics and the API are served at.")
+	var metricsOpts metricsOptions
+	metricsOpts.bindFlags(fs)
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(fs)
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := metricsOpts.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if metricsOpts.needsLiveObjects() {
+		fmt.Fprintln(os.Stderr, "Live objects can't be read from files, --drift-detection, --workload-health and "+
+			"--ownership-conflicts need a cluster")
+		return 2
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	c, err := controllers.NewOfflineClient(scheme, fs.Args())
+	if err != nil {
+		setupLog.Error(err, "unable to read release secrets")
+		return 1
+	}
+	secretReconciler, err := snapshot(context.Background(), c, &metricsOpts, "")
+	if secretReconciler == nil {
+		setupLog.Error(err, "unable to configure controller", "controller", "Secret")
+		return 1
+	}
+	if err != nil {
+		// Releases that can't be decoded are part of the metrics
+		setupLog.Error(err, "unable to read all releases")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	mux.Handle(controllers.APIPrefix, secretReconciler.APIHandler())
+	server := &http.Server{Addr: *bindAddress, Handler: mux}
+	ctx := ctrl.SetupSignalHandler()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	setupLog.Info("serving releases read from files", "address", *bindAddress)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		setupLog.Error(err, "problem serving releases")
+		return 1
+	}
+	return 0
+}
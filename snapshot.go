@@ -0,0 +1,253 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"gerrit.wikimedia.org/r/operations/software/helm-state-metrics/controllers"
+)
+
+// Prefix of the metrics of helm-state-metrics in the registry, which also
+// holds the metrics of controller-runtime and client-go.
+const snapshotMetricsPrefix = "helm_"
+
+// snapshotSample is a single sample of a snapshot in JSON and table output
+type snapshotSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// runSnapshot implements the snapshot subcommand, printing the metrics of all
+// releases once.
+func runSnapshot(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s snapshot [flags]\n\n"+
+			"Read all helm release secrets once and print the metrics the controller would export.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	namespace := fs.String("namespace", "", "Namespace to read releases from. Defaults to all namespaces.")
+	output := fs.String("output", "text", "Output format, one of text (Prometheus text format), json or table.")
+	textfile := fs.String("textfile", "",
+		"Path of a file (like /var/lib/node_exporter/helm.prom) to atomically write the metrics to in Prometheus "+
+			"text format for the node_exporter textfile collector, instead of printing them.")
+	var metricsOpts metricsOptions
+	metricsOpts.bindFlags(fs)
+	fromFiles := addFromFilesFlag(fs)
+	addKubeconfigFlag(fs)
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(fs)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := metricsOpts.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *output != "text" && *output != "json" && *output != "table" {
+		fmt.Fprintf(os.Stderr, "Invalid output format %q\n", *output)
+		return 2
+	}
+	if *fromFiles != "" && metricsOpts.needsLiveObjects() {
+		fmt.Fprintln(os.Stderr, "Live objects can't be read from files, --drift-detection, --workload-health and "+
+			"--ownership-conflicts need a cluster")
+		return 2
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	c, err := newClient(*fromFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create client: %v\n", err)
+		return 1
+	}
+	// Releases that can't be reconciled are part of the metrics, so the
+	// snapshot is written anyways.
+	status := 0
+	if _, err := snapshot(context.Background(), c, &metricsOpts, *namespace); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to take snapshot: %v\n", err)
+		status = 1
+	}
+	families, err := gatherSnapshot()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to gather metrics: %v\n", err)
+		return 1
+	}
+
+	if *textfile != "" {
+		err = writeTextfile(*textfile, families)
+	} else {
+		err = writeSnapshot(os.Stdout, *output, families)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write snapshot: %v\n", err)
+		return 1
+	}
+	return status
+}
+
+// snapshot reconciles all releases (and namespaces if namespace labels are
+// exported) once. The returned reconciler holds the observed releases, even if
+// some of them could not be reconciled.
+func snapshot(ctx context.Context, c client.Client, metricsOpts *metricsOptions, namespace string) (*controllers.SecretReconciler, error) {
+	secretReconciler, err := metricsOpts.secretReconciler(c)
+	if err != nil {
+		return nil, err
+	}
+	if namespaceReconciler := metricsOpts.namespaceReconciler(c); namespaceReconciler != nil {
+		if err := namespaceReconciler.Snapshot(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return secretReconciler, secretReconciler.Snapshot(ctx, namespace)
+}
+
+// gatherSnapshot returns the metrics of helm-state-metrics from the registry
+func gatherSnapshot() ([]*dto.MetricFamily, error) {
+	all, err := metrics.Registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var families []*dto.MetricFamily
+	for _, mf := range all {
+		if strings.HasPrefix(mf.GetName(), snapshotMetricsPrefix) && len(mf.Metric) > 0 {
+			families = append(families, mf)
+		}
+	}
+	return families, nil
+}
+
+// writeSnapshot writes families to w in the given output format
+func writeSnapshot(w io.Writer, output string, families []*dto.MetricFamily) error {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(snapshotSamples(families))
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "METRIC\tLABELS\tVALUE")
+		for _, s := range snapshotSamples(families) {
+			labels := make([]string, 0, len(s.Labels))
+			for k, v := range s.Labels {
+				labels = append(labels, k+"="+v)
+			}
+			sort.Strings(labels)
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Name, strings.Join(labels, ","), strconv.FormatFloat(s.Value, 'f', -1, 64))
+		}
+		return tw.Flush()
+	default:
+		for _, mf := range families {
+			if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// writeTextfile atomically replaces path with families in Prometheus text
+// format. The temporary file does not end in .prom, so the textfile collector
+// ignores it.
+func writeTextfile(path string, families []*dto.MetricFamily) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := writeSnapshot(f, "text", families); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// snapshotSamples flattens families into samples the way the text format does
+// (histograms as _bucket, _sum and _count).
+func snapshotSamples(families []*dto.MetricFamily) []snapshotSample {
+	var samples []snapshotSample
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			add := func(suffix string, value float64, extra ...string) {
+				sl := make(map[string]string, len(labels)+1)
+				for k, v := range labels {
+					sl[k] = v
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					sl[extra[i]] = extra[i+1]
+				}
+				samples = append(samples, snapshotSample{Name: mf.GetName() + suffix, Labels: sl, Value: value})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.Bucket {
+					add("_bucket", float64(b.GetCumulativeCount()), "le", fmt.Sprint(b.GetUpperBound()))
+				}
+				add("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					add("", q.GetValue(), "quantile", fmt.Sprint(q.GetQuantile()))
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			default:
+				add("", m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return samples
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2022 - Janis Meybohm, Wikimedia Foundation Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gerrit.wikimedia.org/r/operations/software/helm-state-metrics/controllers"
+)
+
+// runVerifyAuditLog implements the verify-audit-log subcommand, checking the
+// hash chain of audit log files.
+func runVerifyAuditLog(args []string) int {
+	fs := flag.NewFlagSet("verify-audit-log", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify-audit-log FILE...\n\n"+
+			"Verify the hash chain of audit log files, given oldest first (like audit.log.2 audit.log.1 audit.log).\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	hash := ""
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to verify audit log: %v\n", err)
+			return 1
+		}
+		hash, err = controllers.VerifyAuditLog(f, hash)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+	}
+	fmt.Println("OK")
+	return 0
+}